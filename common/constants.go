@@ -16,6 +16,9 @@ var TopUpLink = ""
 
 var UsingSQLite = false
 
+// TrustedProxies is used to determine the real client IP behind reverse proxies, e.g. "127.0.0.1,10.0.0.0/8"
+var TrustedProxies []string
+
 // Any options with "Secret", "Token" in its key won't be return by GetOptions
 
 var SessionSecret = uuid.New().String()
@@ -51,12 +54,30 @@ var WeChatAccountQRCodeImageURL = ""
 var TurnstileSiteKey = ""
 var TurnstileSecretKey = ""
 
+// MetricsToken protects /metrics, the endpoint is disabled if it is empty
+var MetricsToken = ""
+
 var QuotaForNewUser = 0
 var ChannelDisableThreshold = 5.0
 var AutomaticDisableChannelEnabled = false
+
+// The circuit breaker of channels opens after ChannelBreakerFailureThreshold failures within ChannelBreakerWindow seconds,
+// and probes the channel every ChannelBreakerCooldown seconds until it recovers.
+var ChannelBreakerFailureThreshold = 3
+var ChannelBreakerWindow = 60
+var ChannelBreakerCooldown = 300
+
+// ChannelTestConcurrency is the max number of channels tested at the same time
+var ChannelTestConcurrency = 4
+
+// RelayLatencySampleRate is the ratio of relay requests recorded to the channel health history, 0 means disabled
+var RelayLatencySampleRate = 0.0
 var QuotaRemindThreshold = 1000
 var PreConsumedQuota = 500
 
+// QuotaPerUnit is the quota worth one unit of currency, it is used to convert the quota in the exports
+var QuotaPerUnit = 500 * 1000.0 // $0.002 / 1K tokens
+
 var RootUserEmail = ""
 
 const (
@@ -94,6 +115,9 @@ var (
 
 var RateLimitKeyExpirationDuration = 20 * time.Minute
 
+// RateLimitAlgorithm is either "sliding_window" or "token_bucket"
+var RateLimitAlgorithm = "sliding_window"
+
 const (
 	UserStatusEnabled  = 1 // don't use 0, 0 is the default value!
 	UserStatusDisabled = 2 // also don't use 0
@@ -106,6 +130,13 @@ const (
 	TokenStatusExhausted = 4
 )
 
+const (
+	TokenQuotaPeriodNone    = ""
+	TokenQuotaPeriodDaily   = "daily"
+	TokenQuotaPeriodWeekly  = "weekly"
+	TokenQuotaPeriodMonthly = "monthly"
+)
+
 const (
 	RedemptionCodeStatusEnabled  = 1 // don't use 0, 0 is the default value!
 	RedemptionCodeStatusDisabled = 2 // also don't use 0
@@ -113,9 +144,25 @@ const (
 )
 
 const (
-	ChannelStatusUnknown  = 0
-	ChannelStatusEnabled  = 1 // don't use 0, 0 is the default value!
-	ChannelStatusDisabled = 2 // also don't use 0
+	ChannelStatusUnknown      = 0
+	ChannelStatusEnabled      = 1 // don't use 0, 0 is the default value!
+	ChannelStatusDisabled     = 2 // also don't use 0
+	ChannelStatusAutoDisabled = 3 // disabled by the circuit breaker, will be enabled again once it recovers
+)
+
+const (
+	ChannelKeyStatusEnabled  = 1
+	ChannelKeyStatusDisabled = 2
+)
+
+const (
+	WebhookStatusEnabled  = 1
+	WebhookStatusDisabled = 2
+)
+
+const (
+	KeyRotationRoundRobin = "round_robin"
+	KeyRotationLeastUsed  = "least_used"
 )
 
 const (
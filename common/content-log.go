@@ -0,0 +1,94 @@
+package common
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+const DefaultContentLogMaxSize = 16384
+
+// ContentLogGroups are the groups whose requests & responses are captured, comma separated
+var ContentLogGroups = ""
+var ContentLogMaxSize = DefaultContentLogMaxSize // bytes, the request and the response are truncated to this size
+var ContentLogRetentionDays = 30
+
+// ContentLogRedactPatterns are replaced by [REDACTED] before the content is stored, e.g. emails and card numbers
+var ContentLogRedactPatterns = []string{
+	`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`,
+	`\b(?:\d[ -]?){12,18}\d\b`,
+}
+var contentLogRedactRegexps = compileRedactPatterns(ContentLogRedactPatterns)
+var contentLogRedactLock sync.RWMutex
+
+func compileRedactPatterns(patterns []string) []*regexp.Regexp {
+	regexps := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		regexps = append(regexps, regexp.MustCompile(pattern))
+	}
+	return regexps
+}
+
+func IsContentLogGroup(group string) bool {
+	for _, g := range strings.Split(ContentLogGroups, ",") {
+		if strings.TrimSpace(g) == group && group != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func ContentLogRedactPatterns2JSONString() string {
+	contentLogRedactLock.RLock()
+	defer contentLogRedactLock.RUnlock()
+	jsonBytes, err := json.Marshal(ContentLogRedactPatterns)
+	if err != nil {
+		SysError("Error marshalling content log redact patterns: " + err.Error())
+	}
+	return string(jsonBytes)
+}
+
+func UpdateContentLogRedactPatternsByJSONString(jsonStr string) error {
+	var patterns []string
+	err := json.Unmarshal([]byte(jsonStr), &patterns)
+	if err != nil {
+		return err
+	}
+	regexps := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return err
+		}
+		regexps = append(regexps, re)
+	}
+	contentLogRedactLock.Lock()
+	ContentLogRedactPatterns = patterns
+	contentLogRedactRegexps = regexps
+	contentLogRedactLock.Unlock()
+	return nil
+}
+
+// RedactContent replaces the matches of the redact patterns with [REDACTED]
+func RedactContent(content string) string {
+	contentLogRedactLock.RLock()
+	defer contentLogRedactLock.RUnlock()
+	for _, re := range contentLogRedactRegexps {
+		content = re.ReplaceAllString(content, "[REDACTED]")
+	}
+	return content
+}
+
+// TruncateContent cuts the content to at most maxSize bytes without splitting a character, returns true if it was cut
+func TruncateContent(content string, maxSize int) (string, bool) {
+	if maxSize <= 0 || len(content) <= maxSize {
+		return content, false
+	}
+	i := maxSize
+	for i > 0 && !utf8.RuneStart(content[i]) {
+		i--
+	}
+	return content[:i], true
+}
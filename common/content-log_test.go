@@ -0,0 +1,80 @@
+package common
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func setTestRedactPatterns(t *testing.T, jsonStr string) {
+	previous := ContentLogRedactPatterns2JSONString()
+	t.Cleanup(func() {
+		_ = UpdateContentLogRedactPatternsByJSONString(previous)
+	})
+	err := UpdateContentLogRedactPatternsByJSONString(jsonStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRedactContentDefaultPatterns(t *testing.T) {
+	content := `{"messages":[{"content":"mail me at john.doe@example.com, card 4111 1111 1111 1111, order 12345"}]}`
+	redacted := RedactContent(content)
+	if strings.Contains(redacted, "john.doe@example.com") || strings.Contains(redacted, "4111") {
+		t.Errorf("the email or the card number was not redacted: %s", redacted)
+	}
+	if strings.Count(redacted, "[REDACTED]") != 2 {
+		t.Errorf("redacted = %s, want two matches replaced", redacted)
+	}
+	if !strings.Contains(redacted, "order 12345") {
+		t.Errorf("short numbers should be kept: %s", redacted)
+	}
+}
+
+func TestUpdateContentLogRedactPatterns(t *testing.T) {
+	setTestRedactPatterns(t, `["sk-[A-Za-z0-9]+"]`)
+	redacted := RedactContent("key sk-abc123 for john.doe@example.com")
+	if redacted != "key [REDACTED] for john.doe@example.com" {
+		t.Errorf("redacted = %q, want only the new pattern applied", redacted)
+	}
+	err := UpdateContentLogRedactPatternsByJSONString(`["("]`)
+	if err == nil {
+		t.Fatal("an invalid pattern should be rejected")
+	}
+	if ContentLogRedactPatterns2JSONString() != `["sk-[A-Za-z0-9]+"]` {
+		t.Errorf("patterns = %s, want them kept after an invalid update", ContentLogRedactPatterns2JSONString())
+	}
+}
+
+func TestTruncateContent(t *testing.T) {
+	content, truncated := TruncateContent("hello", 10)
+	if content != "hello" || truncated {
+		t.Errorf("content = %q, truncated = %v, want the content kept", content, truncated)
+	}
+	content, truncated = TruncateContent("hello world", 5)
+	if content != "hello" || !truncated {
+		t.Errorf("content = %q, truncated = %v, want %q and true", content, truncated, "hello")
+	}
+	content, truncated = TruncateContent("hello world", 0)
+	if content != "hello world" || truncated {
+		t.Errorf("content = %q, truncated = %v, want no limit with a size of 0", content, truncated)
+	}
+}
+
+func TestTruncateContentKeepsUTF8Valid(t *testing.T) {
+	// 你 and 好 are 3 bytes each, 😀 is 4 bytes
+	text := "你好😀"
+	for maxSize := 1; maxSize < len(text); maxSize++ {
+		content, truncated := TruncateContent(text, maxSize)
+		if !truncated {
+			t.Errorf("size %d: the content should be truncated", maxSize)
+		}
+		if !utf8.ValidString(content) || len(content) > maxSize || !strings.HasPrefix(text, content) {
+			t.Errorf("size %d: content = %q, want a valid prefix of at most %d bytes", maxSize, content, maxSize)
+		}
+	}
+	content, _ := TruncateContent(text, 7)
+	if content != "你好" {
+		t.Errorf("content = %q, want %q", content, "你好")
+	}
+}
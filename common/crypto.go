@@ -1,6 +1,14 @@
 package common
 
-import "golang.org/x/crypto/bcrypt"
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TokenKeySalt is generated once and stored in the database, see model.initTokenKeySalt
+var TokenKeySalt []byte
 
 func Password2Hash(password string) (string, error) {
 	passwordBytes := []byte(password)
@@ -12,3 +20,10 @@ func ValidatePasswordAndHash(password string, hash string) bool {
 	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
 	return err == nil
 }
+
+// HashTokenKey hashes the key of a token, the hash is deterministic so it can be used for lookups
+func HashTokenKey(key string) string {
+	mac := hmac.New(sha256.New, TokenKeySalt)
+	mac.Write([]byte(key))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -3,6 +3,7 @@ package common
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"io"
 )
@@ -24,3 +25,12 @@ func UnmarshalBodyReusable(c *gin.Context, v any) error {
 	c.Request.Body = io.NopCloser(bytes.NewBuffer(requestBody))
 	return nil
 }
+
+// MessageWithRequestId appends the request id to the error message, so the user can report it
+func MessageWithRequestId(c *gin.Context, message string) string {
+	requestId := c.GetString(RequestIdKey)
+	if requestId == "" {
+		return message
+	}
+	return fmt.Sprintf("%s (request id: %s)", message, requestId)
+}
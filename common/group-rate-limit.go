@@ -0,0 +1,36 @@
+package common
+
+import "encoding/json"
+
+type GroupRateLimit struct {
+	RPM int `json:"rpm"` // requests per minute, 0 means unlimited
+	TPM int `json:"tpm"` // tokens per minute, 0 means unlimited
+}
+
+// GroupRateLimits are the limits of each user in each group, tokens without their own limits are limited by them too,
+// the group of a request is the group of its token if set, otherwise the group of the user
+var GroupRateLimits = map[string]GroupRateLimit{
+	"default": {RPM: 0, TPM: 0},
+}
+
+func GroupRateLimit2JSONString() string {
+	jsonBytes, err := json.Marshal(GroupRateLimits)
+	if err != nil {
+		SysError("Error marshalling group rate limit: " + err.Error())
+	}
+	return string(jsonBytes)
+}
+
+func UpdateGroupRateLimitByJSONString(jsonStr string) error {
+	groupRateLimits := make(map[string]GroupRateLimit)
+	err := json.Unmarshal([]byte(jsonStr), &groupRateLimits)
+	if err != nil {
+		return err
+	}
+	GroupRateLimits = groupRateLimits
+	return nil
+}
+
+func GetGroupRateLimit(name string) GroupRateLimit {
+	return GroupRateLimits[name]
+}
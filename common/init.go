@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 var (
@@ -13,16 +14,19 @@ var (
 	PrintVersion = flag.Bool("version", false, "print version and exit")
 	PrintHelp    = flag.Bool("help", false, "print help and exit")
 	LogDir       = flag.String("log-dir", "", "specify the log directory")
+
+	RotateMasterKey = flag.Bool("rotate-master-key", false, "re-wrap the data key with NEW_MASTER_KEY and exit")
 )
 
 func printHelp() {
 	fmt.Println("One API " + Version + " - All in one API service for OpenAI API.")
 	fmt.Println("Copyright (C) 2023 JustSong. All rights reserved.")
 	fmt.Println("GitHub: https://github.com/songquanpeng/one-api")
-	fmt.Println("Usage: one-api [--port <port>] [--log-dir <log directory>] [--version] [--help]")
+	fmt.Println("Usage: one-api [--port <port>] [--log-dir <log directory>] [--rotate-master-key] [--version] [--help]")
 }
 
-func init() {
+// ParseFlags parses the command line, it is called by main rather than init so the test binaries can parse their own flags
+func ParseFlags() {
 	flag.Parse()
 
 	if *PrintVersion {
@@ -35,12 +39,6 @@ func init() {
 		os.Exit(0)
 	}
 
-	if os.Getenv("SESSION_SECRET") != "" {
-		SessionSecret = os.Getenv("SESSION_SECRET")
-	}
-	if os.Getenv("SQLITE_PATH") != "" {
-		SQLitePath = os.Getenv("SQLITE_PATH")
-	}
 	if *LogDir != "" {
 		var err error
 		*LogDir, err = filepath.Abs(*LogDir)
@@ -55,3 +53,26 @@ func init() {
 		}
 	}
 }
+
+func init() {
+	if os.Getenv("SESSION_SECRET") != "" {
+		SessionSecret = os.Getenv("SESSION_SECRET")
+	}
+	if os.Getenv("SQLITE_PATH") != "" {
+		SQLitePath = os.Getenv("SQLITE_PATH")
+	}
+	if os.Getenv("RATE_LIMIT_ALGORITHM") != "" {
+		RateLimitAlgorithm = os.Getenv("RATE_LIMIT_ALGORITHM")
+	}
+	if os.Getenv("TRUSTED_PROXIES") != "" {
+		for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+			proxy = strings.TrimSpace(proxy)
+			if proxy != "" {
+				TrustedProxies = append(TrustedProxies, proxy)
+			}
+		}
+	}
+	if os.Getenv("LOG_ARCHIVE_DIR") != "" {
+		LogArchiveDir = os.Getenv("LOG_ARCHIVE_DIR")
+	}
+}
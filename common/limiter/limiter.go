@@ -0,0 +1,89 @@
+package limiter
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"one-api/common"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AlgorithmSlidingWindow = "sliding_window"
+	AlgorithmTokenBucket   = "token_bucket"
+)
+
+type Result struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	ResetAfter time.Duration // time until the full limit is available again
+	RetryAfter time.Duration // only set when not allowed
+}
+
+// Limiter allows at most limit units per period for each key.
+// Implementations must be safe for concurrent use, the Redis ones are atomic across instances.
+type Limiter interface {
+	// Allow consumes cost units if they are available.
+	// A cost of 0 only checks whether the key still has allowance left.
+	Allow(ctx context.Context, key string, limit int, period time.Duration, cost int) (*Result, error)
+	// Add consumes cost units unconditionally, used when the cost is only known afterwards (e.g. tokens of a response).
+	Add(ctx context.Context, key string, limit int, period time.Duration, cost int) (*Result, error)
+}
+
+// New returns a limiter with the given algorithm, backed by Redis if it is enabled, otherwise by memory.
+func New(algorithm string) Limiter {
+	switch algorithm {
+	case AlgorithmTokenBucket:
+		if common.RedisEnabled {
+			return &redisTokenBucket{}
+		}
+		return newMemoryTokenBucket(common.RateLimitKeyExpirationDuration)
+	default:
+		if common.RedisEnabled {
+			return &redisSlidingWindow{}
+		}
+		return newMemorySlidingWindow(common.RateLimitKeyExpirationDuration)
+	}
+}
+
+var defaultLimiter Limiter
+var defaultLimiterOnce sync.Once
+
+// Default returns the shared limiter using common.RateLimitAlgorithm.
+// Make sure Redis is initialized before calling this function.
+func Default() Limiter {
+	defaultLimiterOnce.Do(func() {
+		defaultLimiter = New(common.RateLimitAlgorithm)
+	})
+	return defaultLimiter
+}
+
+func minCost(cost int) int {
+	if cost < 1 {
+		return 1
+	}
+	return cost
+}
+
+// redisKey namespaces the keys by version and algorithm, the previous rate limiter kept lists under "rateLimit:<key>"
+// and the algorithms store different types, the key itself is a hash tag so the keys of one limit share a slot
+func redisKey(algorithm string, key string) string {
+	return "rateLimit:v2:" + algorithm + ":{" + key + "}"
+}
+
+// runScript runs the script and starts over once if a key holds another type,
+// e.g. left by another version during a rolling deploy, instead of failing every request until the key expires
+func runScript(ctx context.Context, script *redis.Script, keys []string, args ...interface{}) *redis.Cmd {
+	cmd := script.Run(ctx, common.RDB, keys, args...)
+	if err := cmd.Err(); err != nil && strings.Contains(err.Error(), "WRONGTYPE") {
+		common.SysError("rate limit keys of another type are replaced: " + strings.Join(keys, ", "))
+		err = common.RDB.Del(ctx, keys...).Err()
+		if err != nil {
+			return cmd
+		}
+		cmd = script.Run(ctx, common.RDB, keys, args...)
+	}
+	return cmd
+}
@@ -0,0 +1,199 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"one-api/common"
+	"os"
+	"testing"
+	"time"
+)
+
+// testLimiters returns the in-memory limiters, and the Redis ones if REDIS_CONN_STRING is set
+func testLimiters(t *testing.T) map[string]Limiter {
+	limiters := map[string]Limiter{
+		"memory_sliding_window": newMemorySlidingWindow(0),
+		"memory_token_bucket":   newMemoryTokenBucket(0),
+	}
+	if os.Getenv("REDIS_CONN_STRING") == "" {
+		return limiters
+	}
+	err := common.InitRedisClient()
+	if err != nil {
+		t.Fatalf("failed to connect to Redis: %s", err.Error())
+	}
+	limiters["redis_sliding_window"] = &redisSlidingWindow{}
+	limiters["redis_token_bucket"] = &redisTokenBucket{}
+	return limiters
+}
+
+func testKey(t *testing.T) string {
+	return fmt.Sprintf("test:%s:%d", t.Name(), time.Now().UnixNano())
+}
+
+func TestAllowUpToLimit(t *testing.T) {
+	for name, l := range testLimiters(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			key := testKey(t)
+			for i := 0; i < 3; i++ {
+				result, err := l.Allow(ctx, key, 3, time.Minute, 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !result.Allowed {
+					t.Fatalf("request %d should be allowed", i+1)
+				}
+				if result.Remaining != 2-i {
+					t.Errorf("remaining after request %d = %d, want %d", i+1, result.Remaining, 2-i)
+				}
+			}
+			result, err := l.Allow(ctx, key, 3, time.Minute, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Allowed {
+				t.Fatal("request over the limit should be denied")
+			}
+			if result.Limit != 3 || result.Remaining != 0 {
+				t.Errorf("limit = %d, remaining = %d, want 3 and 0", result.Limit, result.Remaining)
+			}
+			if result.RetryAfter <= 0 || result.RetryAfter > time.Minute {
+				t.Errorf("retry after = %s, want within (0, 1m]", result.RetryAfter)
+			}
+		})
+	}
+}
+
+func TestAllowWithZeroCostDoesNotConsume(t *testing.T) {
+	for name, l := range testLimiters(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			key := testKey(t)
+			for i := 0; i < 5; i++ {
+				result, err := l.Allow(ctx, key, 1, time.Minute, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !result.Allowed || result.Remaining != 1 {
+					t.Fatalf("check %d: allowed = %v, remaining = %d, want true and 1", i+1, result.Allowed, result.Remaining)
+				}
+			}
+			result, err := l.Allow(ctx, key, 1, time.Minute, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !result.Allowed {
+				t.Fatal("the allowance should be left after the checks")
+			}
+			result, err = l.Allow(ctx, key, 1, time.Minute, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Allowed {
+				t.Fatal("the check should be denied once the allowance is used up")
+			}
+		})
+	}
+}
+
+func TestAddConsumesOverLimit(t *testing.T) {
+	for name, l := range testLimiters(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			key := testKey(t)
+			_, err := l.Add(ctx, key, 100, time.Minute, 150)
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := l.Allow(ctx, key, 100, time.Minute, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Allowed {
+				t.Fatal("the key should be exhausted after adding more than the limit")
+			}
+			if result.Remaining != 0 {
+				t.Errorf("remaining = %d, want 0", result.Remaining)
+			}
+		})
+	}
+}
+
+func TestAllowAfterReset(t *testing.T) {
+	period := 300 * time.Millisecond
+	for name, l := range testLimiters(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			key := testKey(t)
+			result, err := l.Allow(ctx, key, 2, period, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !result.Allowed {
+				t.Fatal("the first request should be allowed")
+			}
+			if result.ResetAfter <= 0 || result.ResetAfter > period {
+				t.Errorf("reset after = %s, want within (0, %s]", result.ResetAfter, period)
+			}
+			result, err = l.Allow(ctx, key, 2, period, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Allowed {
+				t.Fatal("the request should be denied before the reset")
+			}
+			if result.RetryAfter <= 0 || result.RetryAfter > period {
+				t.Errorf("retry after = %s, want within (0, %s]", result.RetryAfter, period)
+			}
+			time.Sleep(result.RetryAfter + 50*time.Millisecond)
+			result, err = l.Allow(ctx, key, 2, period, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !result.Allowed {
+				t.Fatal("the request should be allowed after the retry after")
+			}
+			time.Sleep(period + 50*time.Millisecond)
+			result, err = l.Allow(ctx, key, 2, period, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !result.Allowed {
+				t.Fatal("the full limit should be available after the period")
+			}
+		})
+	}
+}
+
+func TestRedisKeyOfAnotherType(t *testing.T) {
+	if os.Getenv("REDIS_CONN_STRING") == "" {
+		t.Skip("REDIS_CONN_STRING is not set")
+	}
+	err := common.InitRedisClient()
+	if err != nil {
+		t.Fatalf("failed to connect to Redis: %s", err.Error())
+	}
+	ctx := context.Background()
+	limiters := map[string]Limiter{
+		AlgorithmSlidingWindow: &redisSlidingWindow{},
+		AlgorithmTokenBucket:   &redisTokenBucket{},
+	}
+	for algorithm, l := range limiters {
+		t.Run(algorithm, func(t *testing.T) {
+			key := testKey(t)
+			// e.g. the list of the previous rate limiter
+			err := common.RDB.LPush(ctx, redisKey(algorithm, key), "2006-01-02T15:04:05.000Z").Err()
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err := l.Allow(ctx, key, 1, time.Minute, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !result.Allowed {
+				t.Error("the request should be allowed after the key is replaced")
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package limiter
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"one-api/common"
+	"sync"
+	"time"
+)
+
+// Sliding window log: every consumption is recorded with its timestamp,
+// the usage of a key is the sum of the costs within the last period, kept as a running sum
+// so only the entries sliding out of the window are visited.
+
+type slidingWindowEntry struct {
+	time int64 // unit: millisecond
+	cost int
+}
+
+type slidingWindow struct {
+	entries []slidingWindowEntry
+	used    int
+}
+
+type memorySlidingWindow struct {
+	store map[string]*slidingWindow
+	mutex sync.Mutex
+}
+
+func newMemorySlidingWindow(expirationDuration time.Duration) *memorySlidingWindow {
+	l := &memorySlidingWindow{store: make(map[string]*slidingWindow)}
+	if expirationDuration > 0 {
+		go l.clearExpiredItems(expirationDuration)
+	}
+	return l
+}
+
+func (l *memorySlidingWindow) clearExpiredItems(expirationDuration time.Duration) {
+	for {
+		time.Sleep(expirationDuration)
+		l.mutex.Lock()
+		now := time.Now().UnixMilli()
+		for key, window := range l.store {
+			entries := window.entries
+			if len(entries) == 0 || now-entries[len(entries)-1].time > expirationDuration.Milliseconds() {
+				delete(l.store, key)
+			}
+		}
+		l.mutex.Unlock()
+	}
+}
+
+func (l *memorySlidingWindow) take(key string, limit int, period time.Duration, cost int, force bool) *Result {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now().UnixMilli()
+	windowStart := now - period.Milliseconds()
+	window, ok := l.store[key]
+	if !ok {
+		window = &slidingWindow{}
+		l.store[key] = window
+	}
+	// [old --> new], drop the entries out of the window
+	i := 0
+	for i < len(window.entries) && window.entries[i].time <= windowStart {
+		window.used -= window.entries[i].cost
+		i++
+	}
+	window.entries = window.entries[i:]
+	allowed := window.used+minCost(cost) <= limit
+	if (allowed || force) && cost > 0 {
+		window.entries = append(window.entries, slidingWindowEntry{time: now, cost: cost})
+		window.used += cost
+	}
+	entries := window.entries
+	used := window.used
+	result := &Result{
+		Allowed:   allowed,
+		Limit:     limit,
+		Remaining: limit - used,
+	}
+	if len(entries) > 0 {
+		result.ResetAfter = time.Duration(entries[len(entries)-1].time+period.Milliseconds()-now) * time.Millisecond
+	}
+	if !allowed {
+		// wait until enough entries slide out of the window
+		freed := 0
+		for _, entry := range entries {
+			freed += entry.cost
+			if used-freed+minCost(cost) <= limit {
+				result.RetryAfter = time.Duration(entry.time+period.Milliseconds()-now) * time.Millisecond
+				break
+			}
+		}
+	}
+	if result.Remaining < 0 {
+		result.Remaining = 0
+	}
+	return result
+}
+
+func (l *memorySlidingWindow) Allow(ctx context.Context, key string, limit int, period time.Duration, cost int) (*Result, error) {
+	return l.take(key, limit, period, cost, false), nil
+}
+
+func (l *memorySlidingWindow) Add(ctx context.Context, key string, limit int, period time.Duration, cost int) (*Result, error) {
+	return l.take(key, limit, period, cost, true), nil
+}
+
+// KEYS[1]: the entries, KEYS[2]: the sum of their costs; ARGV: now (ms), period (ms), limit, cost, force, member
+// Members are "<unique id>:<cost>", scored by their timestamp.
+// Returns {allowed, used, reset after (ms), retry after (ms)}
+var slidingWindowScript = redis.NewScript(`
+local key = KEYS[1]
+local usedKey = KEYS[2]
+local now = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+local cost = tonumber(ARGV[4])
+local force = tonumber(ARGV[5])
+local function entryCost(member)
+	return tonumber(string.match(member, ':(%d+)$'))
+end
+local used = tonumber(redis.call('GET', usedKey))
+if used == nil then
+	-- the sum is missing, e.g. evicted, count the window once
+	used = 0
+	local entries = redis.call('ZRANGE', key, 0, -1)
+	for i = 1, #entries do
+		used = used + entryCost(entries[i])
+	end
+end
+local expired = redis.call('ZRANGEBYSCORE', key, '-inf', now - period)
+if #expired > 0 then
+	for i = 1, #expired do
+		used = used - entryCost(expired[i])
+	end
+	redis.call('ZREMRANGEBYSCORE', key, '-inf', now - period)
+end
+local need = cost
+if need < 1 then
+	need = 1
+end
+local allowed = 0
+if used + need <= limit then
+	allowed = 1
+end
+if (allowed == 1 or force == 1) and cost > 0 then
+	redis.call('ZADD', key, now, ARGV[6] .. ':' .. cost)
+	used = used + cost
+end
+local reset = 0
+local newest = redis.call('ZRANGE', key, -1, -1, 'WITHSCORES')
+if #newest > 0 then
+	reset = tonumber(newest[2]) + period - now
+end
+local retry = 0
+if allowed == 0 then
+	-- walk from the oldest entries until enough would be freed
+	local freed = 0
+	local start = 0
+	while retry == 0 do
+		local entries = redis.call('ZRANGE', key, start, start + 99, 'WITHSCORES')
+		if #entries == 0 then
+			break
+		end
+		for i = 1, #entries, 2 do
+			freed = freed + entryCost(entries[i])
+			if used - freed + need <= limit then
+				retry = tonumber(entries[i + 1]) + period - now
+				break
+			end
+		end
+		start = start + 100
+	end
+end
+if used > 0 then
+	redis.call('SET', usedKey, used, 'PX', period)
+	redis.call('PEXPIRE', key, period)
+else
+	redis.call('DEL', key, usedKey)
+end
+return {allowed, used, reset, retry}
+`)
+
+type redisSlidingWindow struct{}
+
+func (l *redisSlidingWindow) take(ctx context.Context, key string, limit int, period time.Duration, cost int, force bool) (*Result, error) {
+	forceArg := 0
+	if force {
+		forceArg = 1
+	}
+	now := time.Now().UnixMilli()
+	member := common.GetUUID()
+	key = redisKey(AlgorithmSlidingWindow, key)
+	values, err := runScript(ctx, slidingWindowScript, []string{key, key + ":used"},
+		now, period.Milliseconds(), limit, cost, forceArg, member).Int64Slice()
+	if err != nil {
+		return nil, err
+	}
+	result := &Result{
+		Allowed:    values[0] == 1,
+		Limit:      limit,
+		Remaining:  limit - int(values[1]),
+		ResetAfter: time.Duration(values[2]) * time.Millisecond,
+		RetryAfter: time.Duration(values[3]) * time.Millisecond,
+	}
+	if result.Remaining < 0 {
+		result.Remaining = 0
+	}
+	return result, nil
+}
+
+func (l *redisSlidingWindow) Allow(ctx context.Context, key string, limit int, period time.Duration, cost int) (*Result, error) {
+	return l.take(ctx, key, limit, period, cost, false)
+}
+
+func (l *redisSlidingWindow) Add(ctx context.Context, key string, limit int, period time.Duration, cost int) (*Result, error) {
+	return l.take(ctx, key, limit, period, cost, true)
+}
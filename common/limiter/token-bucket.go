@@ -0,0 +1,151 @@
+package limiter
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Token bucket: the bucket holds at most limit tokens and is refilled at limit/period per second,
+// so bursts up to limit are allowed while the long-term rate is limited.
+// Add may drive the bucket negative, the debt is paid back by later refills.
+
+type tokenBucket struct {
+	tokens float64
+	time   int64 // unit: millisecond
+}
+
+type memoryTokenBucket struct {
+	store map[string]*tokenBucket
+	mutex sync.Mutex
+}
+
+func newMemoryTokenBucket(expirationDuration time.Duration) *memoryTokenBucket {
+	l := &memoryTokenBucket{store: make(map[string]*tokenBucket)}
+	if expirationDuration > 0 {
+		go l.clearExpiredItems(expirationDuration)
+	}
+	return l
+}
+
+func (l *memoryTokenBucket) clearExpiredItems(expirationDuration time.Duration) {
+	for {
+		time.Sleep(expirationDuration)
+		l.mutex.Lock()
+		now := time.Now().UnixMilli()
+		for key, bucket := range l.store {
+			if now-bucket.time > expirationDuration.Milliseconds() {
+				delete(l.store, key)
+			}
+		}
+		l.mutex.Unlock()
+	}
+}
+
+// tokenBucketResult computes the result from the bucket state, shared by the memory & Redis implementations
+func tokenBucketResult(allowed bool, tokens float64, limit int, period time.Duration, cost int) *Result {
+	rate := float64(limit) / float64(period.Milliseconds()) // tokens per millisecond
+	result := &Result{
+		Allowed:    allowed,
+		Limit:      limit,
+		Remaining:  int(math.Max(0, math.Floor(tokens))),
+		ResetAfter: time.Duration(math.Ceil((float64(limit)-tokens)/rate)) * time.Millisecond,
+	}
+	if !allowed {
+		result.RetryAfter = time.Duration(math.Ceil((float64(minCost(cost))-tokens)/rate)) * time.Millisecond
+	}
+	return result
+}
+
+func (l *memoryTokenBucket) take(key string, limit int, period time.Duration, cost int, force bool) *Result {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now().UnixMilli()
+	bucket, ok := l.store[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(limit), time: now}
+		l.store[key] = bucket
+	}
+	rate := float64(limit) / float64(period.Milliseconds())
+	bucket.tokens = math.Min(float64(limit), bucket.tokens+float64(now-bucket.time)*rate)
+	bucket.time = now
+	allowed := bucket.tokens >= float64(minCost(cost))
+	if allowed || force {
+		bucket.tokens -= float64(cost)
+	}
+	return tokenBucketResult(allowed, bucket.tokens, limit, period, cost)
+}
+
+func (l *memoryTokenBucket) Allow(ctx context.Context, key string, limit int, period time.Duration, cost int) (*Result, error) {
+	return l.take(key, limit, period, cost, false), nil
+}
+
+func (l *memoryTokenBucket) Add(ctx context.Context, key string, limit int, period time.Duration, cost int) (*Result, error) {
+	return l.take(key, limit, period, cost, true), nil
+}
+
+// KEYS[1]: key; ARGV: now (ms), period (ms), limit, cost, force
+// Returns {allowed, tokens left}, tokens are returned as string to keep the fraction.
+var tokenBucketScript = redis.NewScript(`
+local key = KEYS[1]
+local now = tonumber(ARGV[1])
+local period = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+local cost = tonumber(ARGV[4])
+local force = tonumber(ARGV[5])
+local state = redis.call('HMGET', key, 'tokens', 'time')
+local tokens = tonumber(state[1])
+local last = tonumber(state[2])
+if tokens == nil or last == nil then
+	tokens = limit
+	last = now
+end
+local rate = limit / period
+tokens = math.min(limit, tokens + math.max(0, now - last) * rate)
+local need = cost
+if need < 1 then
+	need = 1
+end
+local allowed = 0
+if tokens >= need then
+	allowed = 1
+end
+if allowed == 1 or force == 1 then
+	tokens = tokens - cost
+end
+redis.call('HMSET', key, 'tokens', tostring(tokens), 'time', now)
+redis.call('PEXPIRE', key, math.ceil(math.max(period, (limit - tokens) / rate)))
+return {allowed, tostring(tokens)}
+`)
+
+type redisTokenBucket struct{}
+
+func (l *redisTokenBucket) take(ctx context.Context, key string, limit int, period time.Duration, cost int, force bool) (*Result, error) {
+	forceArg := 0
+	if force {
+		forceArg = 1
+	}
+	values, err := runScript(ctx, tokenBucketScript, []string{redisKey(AlgorithmTokenBucket, key)},
+		time.Now().UnixMilli(), period.Milliseconds(), limit, cost, forceArg).Slice()
+	if err != nil {
+		return nil, err
+	}
+	allowed, _ := values[0].(int64)
+	tokensStr, _ := values[1].(string)
+	tokens, err := strconv.ParseFloat(tokensStr, 64)
+	if err != nil {
+		return nil, err
+	}
+	return tokenBucketResult(allowed == 1, tokens, limit, period, cost), nil
+}
+
+func (l *redisTokenBucket) Allow(ctx context.Context, key string, limit int, period time.Duration, cost int) (*Result, error) {
+	return l.take(ctx, key, limit, period, cost, false)
+}
+
+func (l *redisTokenBucket) Add(ctx context.Context, key string, limit int, period time.Duration, cost int) (*Result, error) {
+	return l.take(ctx, key, limit, period, cost, true)
+}
@@ -0,0 +1,62 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// LogRetentionDays is the number of days each type of log is kept, 0 or a missing type means forever,
+// the types are topup, consume, manage, system, audit, channel_health & webhook_deliveries
+var LogRetentionDays = map[string]int{}
+var logRetentionLock sync.RWMutex
+
+var LogRetentionTypes = []string{"topup", "consume", "manage", "system", "audit", "channel_health", "webhook_deliveries"}
+
+// LogArchiveDir is where the deleted logs are archived as gzipped JSONL files, empty means no archive
+var LogArchiveDir = ""
+
+func LogRetentionDays2JSONString() string {
+	logRetentionLock.RLock()
+	defer logRetentionLock.RUnlock()
+	jsonBytes, err := json.Marshal(LogRetentionDays)
+	if err != nil {
+		SysError("Error marshalling log retention days: " + err.Error())
+	}
+	return string(jsonBytes)
+}
+
+func UpdateLogRetentionDaysByJSONString(jsonStr string) error {
+	retentionDays := make(map[string]int)
+	err := json.Unmarshal([]byte(jsonStr), &retentionDays)
+	if err != nil {
+		return err
+	}
+	for logType, days := range retentionDays {
+		if !isLogRetentionType(logType) {
+			return fmt.Errorf("unknown log type: %s", logType)
+		}
+		if days < 0 {
+			return fmt.Errorf("invalid retention days of %s: %d", logType, days)
+		}
+	}
+	logRetentionLock.Lock()
+	LogRetentionDays = retentionDays
+	logRetentionLock.Unlock()
+	return nil
+}
+
+func GetLogRetentionDays(logType string) int {
+	logRetentionLock.RLock()
+	defer logRetentionLock.RUnlock()
+	return LogRetentionDays[logType]
+}
+
+func isLogRetentionType(logType string) bool {
+	for _, t := range LogRetentionTypes {
+		if t == logType {
+			return true
+		}
+	}
+	return false
+}
@@ -1,44 +1,166 @@
 package common
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"gopkg.in/natefinch/lumberjack.v2"
 	"io"
-	"log"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 )
 
+const (
+	LogLevelDebug = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+	LogLevelFatal
+)
+
+var logLevelNames = []string{"DEBUG", "INFO", "WARN", "ERROR", "FATAL"}
+
+// RequestIdKey is the key of the request id in the gin context, it is attached to the logs of the request
+const RequestIdKey = "request_id"
+
+var logLevel = LogLevelInfo
+var logJSON = false
+
+func getEnvInt(name string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+// SetupGinLog sets the log level & format from LOG_LEVEL & LOG_FORMAT,
+// the log files in --log-dir are rotated once they reach LOG_MAX_SIZE megabytes
 func SetupGinLog() {
+	switch strings.ToLower(os.Getenv("LOG_LEVEL")) {
+	case "debug":
+		logLevel = LogLevelDebug
+	case "warn":
+		logLevel = LogLevelWarn
+	case "error":
+		logLevel = LogLevelError
+	}
+	logJSON = strings.ToLower(os.Getenv("LOG_FORMAT")) == "json"
 	if *LogDir != "" {
-		commonLogPath := filepath.Join(*LogDir, "common.log")
-		errorLogPath := filepath.Join(*LogDir, "error.log")
-		commonFd, err := os.OpenFile(commonLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			log.Fatal("failed to open log file")
+		newRotatingFile := func(name string) io.Writer {
+			return &lumberjack.Logger{
+				Filename:   filepath.Join(*LogDir, name),
+				MaxSize:    getEnvInt("LOG_MAX_SIZE", 100),
+				MaxBackups: getEnvInt("LOG_MAX_BACKUPS", 0),
+				MaxAge:     getEnvInt("LOG_MAX_AGE", 0),
+				LocalTime:  true,
+				Compress:   true,
+			}
+		}
+		gin.DefaultWriter = io.MultiWriter(os.Stdout, newRotatingFile("common.log"))
+		gin.DefaultErrorWriter = io.MultiWriter(os.Stderr, newRotatingFile("error.log"))
+	}
+}
+
+func formatLogValue(value any) string {
+	s := fmt.Sprint(value)
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func formatLog(level int, requestId string, msg string, fields []any) []byte {
+	t := time.Now()
+	var buf bytes.Buffer
+	if logJSON {
+		writeJSON := func(key string, value any) {
+			keyBytes, _ := json.Marshal(key)
+			valueBytes, err := json.Marshal(value)
+			if err != nil {
+				valueBytes, _ = json.Marshal(fmt.Sprint(value))
+			}
+			buf.Write(keyBytes)
+			buf.WriteByte(':')
+			buf.Write(valueBytes)
+		}
+		buf.WriteByte('{')
+		writeJSON("time", t.Format(time.RFC3339Nano))
+		buf.WriteByte(',')
+		writeJSON("level", strings.ToLower(logLevelNames[level]))
+		if requestId != "" {
+			buf.WriteByte(',')
+			writeJSON("request_id", requestId)
 		}
-		errorFd, err := os.OpenFile(errorLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			log.Fatal("failed to open log file")
+		buf.WriteByte(',')
+		writeJSON("msg", msg)
+		for i := 0; i+1 < len(fields); i += 2 {
+			buf.WriteByte(',')
+			writeJSON(fmt.Sprint(fields[i]), fields[i+1])
 		}
-		gin.DefaultWriter = io.MultiWriter(os.Stdout, commonFd)
-		gin.DefaultErrorWriter = io.MultiWriter(os.Stderr, errorFd)
+		buf.WriteString("}\n")
+		return buf.Bytes()
 	}
+	_, _ = fmt.Fprintf(&buf, "[%s] %v | ", logLevelNames[level], t.Format("2006/01/02 - 15:04:05"))
+	if requestId != "" {
+		buf.WriteString(requestId)
+		buf.WriteString(" | ")
+	}
+	buf.WriteString(msg)
+	for i := 0; i+1 < len(fields); i += 2 {
+		_, _ = fmt.Fprintf(&buf, " %v=%s", fields[i], formatLogValue(fields[i+1]))
+	}
+	buf.WriteString(" \n")
+	return buf.Bytes()
+}
+
+func logHelper(ctx context.Context, level int, msg string, fields []any) {
+	if level < logLevel {
+		return
+	}
+	requestId := ""
+	if ctx != nil {
+		requestId, _ = ctx.Value(RequestIdKey).(string)
+	}
+	writer := gin.DefaultWriter
+	if level >= LogLevelError {
+		writer = gin.DefaultErrorWriter
+	}
+	_, _ = writer.Write(formatLog(level, requestId, msg, fields))
+}
+
+// LogDebug writes the message and the key value pairs in fields,
+// the request id is attached if ctx is the gin context of a request
+func LogDebug(ctx context.Context, msg string, fields ...any) {
+	logHelper(ctx, LogLevelDebug, msg, fields)
+}
+
+func LogInfo(ctx context.Context, msg string, fields ...any) {
+	logHelper(ctx, LogLevelInfo, msg, fields)
+}
+
+func LogWarn(ctx context.Context, msg string, fields ...any) {
+	logHelper(ctx, LogLevelWarn, msg, fields)
+}
+
+func LogError(ctx context.Context, msg string, fields ...any) {
+	logHelper(ctx, LogLevelError, msg, fields)
 }
 
 func SysLog(s string) {
-	t := time.Now()
-	_, _ = fmt.Fprintf(gin.DefaultWriter, "[SYS] %v | %s \n", t.Format("2006/01/02 - 15:04:05"), s)
+	logHelper(nil, LogLevelInfo, s, nil)
 }
 
 func SysError(s string) {
-	t := time.Now()
-	_, _ = fmt.Fprintf(gin.DefaultErrorWriter, "[SYS] %v | %s \n", t.Format("2006/01/02 - 15:04:05"), s)
+	logHelper(nil, LogLevelError, s, nil)
 }
 
 func FatalLog(v ...any) {
-	t := time.Now()
-	_, _ = fmt.Fprintf(gin.DefaultErrorWriter, "[FATAL] %v | %v \n", t.Format("2006/01/02 - 15:04:05"), v)
+	logHelper(nil, LogLevelFatal, fmt.Sprint(v...), nil)
 	os.Exit(1)
 }
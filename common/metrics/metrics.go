@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"one-api/common"
+	"time"
+)
+
+const namespace = "one_api"
+
+// Registry holds every metric exposed at /metrics, other packages may register their own collectors
+var Registry = prometheus.NewRegistry()
+
+var (
+	RelayRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "relay_requests_total",
+		Help:      "Relay requests by model, channel and response status code.",
+	}, []string{"model", "channel", "status"})
+	RelayDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "relay_request_duration_seconds",
+		Help:      "Relay request latencies by model and channel.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 40, 60, 120, 300},
+	}, []string{"model", "channel"})
+	RelayFirstToken = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "relay_stream_first_token_seconds",
+		Help:      "Time to the first token of stream responses by model and channel.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2, 3, 5, 10, 20, 40},
+	}, []string{"model", "channel"})
+	RelayTokens = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "relay_tokens_total",
+		Help:      "Tokens consumed by model and type (prompt or completion).",
+	}, []string{"model", "type"})
+	QuotaConsumed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "quota_consumed_total",
+		Help:      "Quota consumed by model.",
+	}, []string{"model"})
+	UpstreamErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_errors_total",
+		Help:      "Errors returned by upstream channels by channel and error code.",
+	}, []string{"channel", "code"})
+	RateLimitRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limit_rejections_total",
+		Help:      "Requests rejected by the rate limiters by limiter.",
+	}, []string{"limiter"})
+	DBQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "Database query latencies by operation.",
+		Buckets:   []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5},
+	}, []string{"operation"})
+)
+
+// redisCollector pings Redis on every scrape, nothing is reported if Redis is not enabled
+type redisCollector struct {
+	up *prometheus.Desc
+}
+
+func (collector *redisCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- collector.up
+}
+
+func (collector *redisCollector) Collect(ch chan<- prometheus.Metric) {
+	if !common.RedisEnabled || common.RDB == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	up := 1.0
+	if err := common.RDB.Ping(ctx).Err(); err != nil {
+		up = 0
+	}
+	ch <- prometheus.MustNewConstMetric(collector.up, prometheus.GaugeValue, up)
+}
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		RelayRequests,
+		RelayDuration,
+		RelayFirstToken,
+		RelayTokens,
+		QuotaConsumed,
+		UpstreamErrors,
+		RateLimitRejections,
+		DBQueryDuration,
+		&redisCollector{up: prometheus.NewDesc(namespace+"_redis_up", "Whether Redis responds to ping.", nil, nil)},
+	)
+}
+
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
@@ -0,0 +1,112 @@
+package common
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// parseSubnet accepts both CIDR notation and a single IP address
+func parseSubnet(subnet string) (*net.IPNet, error) {
+	if !strings.Contains(subnet, "/") {
+		ip := net.ParseIP(subnet)
+		if ip == nil {
+			return nil, fmt.Errorf("无效的 IP 地址：%s", subnet)
+		}
+		if ip.To4() != nil {
+			subnet += "/32"
+		} else {
+			subnet += "/128"
+		}
+	}
+	_, ipNet, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return nil, fmt.Errorf("无效的网段：%s", subnet)
+	}
+	return ipNet, nil
+}
+
+func splitSubnets(subnets string) []string {
+	return strings.FieldsFunc(subnets, func(r rune) bool {
+		return r == ',' || r == '\n' || r == ' '
+	})
+}
+
+// ValidateSubnets checks a comma or newline separated list of CIDRs, e.g. "10.0.0.0/8,192.168.1.1"
+func ValidateSubnets(subnets string) error {
+	for _, subnet := range splitSubnets(subnets) {
+		if _, err := parseSubnet(subnet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ParseSubnets parses a comma or newline separated list of CIDRs once so they can be matched many times,
+// the invalid ones are skipped. It returns nil if the list is empty, which means no restriction
+func ParseSubnets(subnets string) []*net.IPNet {
+	list := splitSubnets(subnets)
+	if len(list) == 0 {
+		return nil
+	}
+	ipNets := make([]*net.IPNet, 0, len(list))
+	for _, subnet := range list {
+		ipNet, err := parseSubnet(subnet)
+		if err != nil {
+			continue
+		}
+		ipNets = append(ipNets, ipNet)
+	}
+	return ipNets
+}
+
+// IsIpInSubnets reports whether the ip belongs to one of the subnets parsed by ParseSubnets.
+// Nil subnets means no restriction.
+func IsIpInSubnets(ip string, subnets []*net.IPNet) bool {
+	if subnets == nil {
+		return true
+	}
+	parsedIp := net.ParseIP(ip)
+	if parsedIp == nil {
+		return false
+	}
+	for _, ipNet := range subnets {
+		if ipNet.Contains(parsedIp) {
+			return true
+		}
+	}
+	return false
+}
+
+// the ranges which are neither private nor link-local in the net package but are not reachable on the internet either,
+// e.g. the shared address space holds the metadata service of some clouds
+var nonPublicSubnets = []*net.IPNet{
+	mustParseSubnet("0.0.0.0/8"),
+	mustParseSubnet("100.64.0.0/10"),
+	mustParseSubnet("192.0.0.0/24"),
+	mustParseSubnet("198.18.0.0/15"),
+	mustParseSubnet("240.0.0.0/4"),
+	mustParseSubnet("64:ff9b::/96"),
+}
+
+func mustParseSubnet(subnet string) *net.IPNet {
+	ipNet, err := parseSubnet(subnet)
+	if err != nil {
+		panic(err)
+	}
+	return ipNet
+}
+
+// IsPublicIP reports whether the ip is a global unicast address outside the loopback, private, link-local
+// (e.g. 169.254.169.254 of the metadata services) and reserved ranges
+func IsPublicIP(ip net.IP) bool {
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, ipNet := range nonPublicSubnets {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,42 @@
+package common
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIsPublicIP(t *testing.T) {
+	for _, ip := range []string{"8.8.8.8", "1.1.1.1", "2606:4700:4700::1111"} {
+		if !IsPublicIP(net.ParseIP(ip)) {
+			t.Errorf("%s should be public", ip)
+		}
+	}
+	for _, ip := range []string{
+		"127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254", "100.100.100.200",
+		"0.0.0.0", "255.255.255.255", "::1", "fe80::1", "fd00:ec2::254", "::ffff:127.0.0.1", "::ffff:10.0.0.1",
+	} {
+		if IsPublicIP(net.ParseIP(ip)) {
+			t.Errorf("%s should not be public", ip)
+		}
+	}
+}
+
+func TestIsIpInSubnets(t *testing.T) {
+	subnets := ParseSubnets("10.0.0.0/8, 203.0.113.7\n2001:db8::/32")
+	for _, ip := range []string{"10.1.2.3", "203.0.113.7", "2001:db8::1"} {
+		if !IsIpInSubnets(ip, subnets) {
+			t.Errorf("%s should be allowed", ip)
+		}
+	}
+	for _, ip := range []string{"192.168.1.1", "203.0.113.8", "not an ip"} {
+		if IsIpInSubnets(ip, subnets) {
+			t.Errorf("%s should not be allowed", ip)
+		}
+	}
+	if !IsIpInSubnets("192.168.1.1", ParseSubnets("")) {
+		t.Error("empty subnets should not restrict")
+	}
+	if IsIpInSubnets("192.168.1.1", ParseSubnets("invalid")) {
+		t.Error("a list of invalid subnets should allow nothing")
+	}
+}
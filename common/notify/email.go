@@ -0,0 +1,26 @@
+package notify
+
+import (
+	"errors"
+	"one-api/common"
+)
+
+// EmailNotifier sends the message by SMTP, an empty To means the root user
+type EmailNotifier struct {
+	To string
+}
+
+func (n *EmailNotifier) Notify(message *Message) error {
+	to := n.To
+	if to == "" {
+		to = common.RootUserEmail
+	}
+	if to == "" {
+		// nobody to notify, don't retry
+		return nil
+	}
+	if common.SMTPServer == "" {
+		return errors.New("SMTP is not configured")
+	}
+	return common.SendEmail(message.Title, to, message.Content)
+}
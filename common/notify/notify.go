@@ -0,0 +1,301 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"one-api/common"
+	"sync"
+	"time"
+)
+
+const (
+	EventChannelDisabled     = "channel_disabled"
+	EventChannelEnabled      = "channel_enabled"
+	EventChannelTestFinished = "channel_test_finished"
+	EventQuotaLow            = "quota_low"
+	EventBudgetAlert         = "budget_alert"
+)
+
+const (
+	SinkTypeWebhook  = "webhook"
+	SinkTypeSlack    = "slack"
+	SinkTypeDingTalk = "dingtalk"
+	SinkTypeFeishu   = "feishu"
+	SinkTypeWeCom    = "wecom"
+	SinkTypeEmail    = "email"
+)
+
+type Message struct {
+	Event     string `json:"event"`
+	Title     string `json:"title"`
+	Content   string `json:"content"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// Notifier delivers a message to a sink, implementations should return an error if the delivery should be retried.
+type Notifier interface {
+	Notify(message *Message) error
+}
+
+// Sink is a configured notifier and the events it receives, "*" means all events
+type Sink struct {
+	Name   string   `json:"name"`
+	Type   string   `json:"type"`
+	URL    string   `json:"url,omitempty"`
+	Secret string   `json:"secret,omitempty"`
+	To     string   `json:"to,omitempty"` // email receivers separated by ";", empty means the root user
+	Events []string `json:"events"`
+
+	publicOnly bool // set by users, only public addresses can be reached
+}
+
+func (sink *Sink) accepts(event string) bool {
+	for _, e := range sink.Events {
+		if e == "*" || e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (sink *Sink) notifier() (Notifier, error) {
+	client := httpClient
+	if sink.publicOnly {
+		client = publicHTTPClient
+	}
+	switch sink.Type {
+	case SinkTypeWebhook:
+		return &webhookNotifier{client: client, url: sink.URL, secret: sink.Secret}, nil
+	case SinkTypeSlack:
+		return &slackNotifier{client: client, url: sink.URL}, nil
+	case SinkTypeDingTalk:
+		return &dingTalkNotifier{client: client, url: sink.URL, secret: sink.Secret}, nil
+	case SinkTypeFeishu:
+		return &feishuNotifier{client: client, url: sink.URL, secret: sink.Secret}, nil
+	case SinkTypeWeCom:
+		return &weComNotifier{client: client, url: sink.URL}, nil
+	case SinkTypeEmail:
+		return &EmailNotifier{To: sink.To}, nil
+	}
+	return nil, fmt.Errorf("unknown notification sink type %s", sink.Type)
+}
+
+var sinks []*Sink
+var sinksLock sync.RWMutex
+
+func Sinks2JSONString() string {
+	sinksLock.RLock()
+	defer sinksLock.RUnlock()
+	jsonBytes, err := json.Marshal(sinks)
+	if err != nil {
+		common.SysError("Error marshalling notification sinks: " + err.Error())
+	}
+	return string(jsonBytes)
+}
+
+// ParseSinks parses the sinks in JSON and checks the type & url of each
+func ParseSinks(jsonStr string) ([]*Sink, error) {
+	var newSinks []*Sink
+	err := json.Unmarshal([]byte(jsonStr), &newSinks)
+	if err != nil {
+		return nil, err
+	}
+	for _, sink := range newSinks {
+		if _, err := sink.notifier(); err != nil {
+			return nil, err
+		}
+		if sink.Type == SinkTypeEmail {
+			continue
+		}
+		u, err := url.Parse(sink.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("the url of notification sink %s is invalid", sink.Name)
+		}
+	}
+	return newSinks, nil
+}
+
+// ParseUserSinks parses the sinks set by a user, the hosts must resolve to public addresses and
+// only public addresses are dialed when the sinks are sent to, so they can't reach the internal network
+func ParseUserSinks(jsonStr string) ([]*Sink, error) {
+	userSinks, err := ParseSinks(jsonStr)
+	if err != nil {
+		return nil, err
+	}
+	for _, sink := range userSinks {
+		if sink.Type == SinkTypeEmail {
+			continue
+		}
+		err = checkPublicURL(sink.URL)
+		if err != nil {
+			return nil, fmt.Errorf("the url of notification sink %s is not allowed: %s", sink.Name, err.Error())
+		}
+		sink.publicOnly = true
+	}
+	return userSinks, nil
+}
+
+func UpdateSinksByJSONString(jsonStr string) error {
+	newSinks, err := ParseSinks(jsonStr)
+	if err != nil {
+		return err
+	}
+	sinksLock.Lock()
+	sinks = newSinks
+	sinksLock.Unlock()
+	return nil
+}
+
+const redactedValue = "[REDACTED]"
+
+// RedactSinksJSONString hides the urls & secrets of the sinks, the urls of webhooks usually carry credentials too
+func RedactSinksJSONString(jsonStr string) string {
+	var redactedSinks []*Sink
+	if json.Unmarshal([]byte(jsonStr), &redactedSinks) != nil {
+		return redactedValue
+	}
+	for _, sink := range redactedSinks {
+		if sink.URL != "" {
+			sink.URL = redactedValue
+		}
+		if sink.Secret != "" {
+			sink.Secret = redactedValue
+		}
+	}
+	jsonBytes, _ := json.Marshal(redactedSinks)
+	return string(jsonBytes)
+}
+
+// RestoreRedactedSinks puts back the urls & secrets of the sinks submitted as redacted, matched by the name
+func RestoreRedactedSinks(jsonStr string) (string, error) {
+	var newSinks []*Sink
+	err := json.Unmarshal([]byte(jsonStr), &newSinks)
+	if err != nil {
+		return "", err
+	}
+	sinksLock.RLock()
+	current := make(map[string]*Sink, len(sinks))
+	for _, sink := range sinks {
+		current[sink.Name] = sink
+	}
+	sinksLock.RUnlock()
+	for _, sink := range newSinks {
+		if sink.URL != redactedValue && sink.Secret != redactedValue {
+			continue
+		}
+		origin, ok := current[sink.Name]
+		if !ok {
+			return "", fmt.Errorf("the url or secret of notification sink %s is redacted", sink.Name)
+		}
+		if sink.URL == redactedValue {
+			sink.URL = origin.URL
+		}
+		if sink.Secret == redactedValue {
+			sink.Secret = origin.Secret
+		}
+	}
+	jsonBytes, err := json.Marshal(newSinks)
+	return string(jsonBytes), err
+}
+
+const maxAttempts = 5
+
+type delivery struct {
+	notifier Notifier
+	message  *Message
+	attempt  int
+}
+
+var queue = make(chan *delivery, 1024)
+var startOnce sync.Once
+
+func start() {
+	startOnce.Do(func() {
+		go func() {
+			for d := range queue {
+				deliver(d)
+			}
+		}()
+	})
+}
+
+func deliver(d *delivery) {
+	err := d.notifier.Notify(d.message)
+	if err == nil {
+		return
+	}
+	d.attempt++
+	if d.attempt >= maxAttempts {
+		common.SysError(fmt.Sprintf("failed to send notification %s after %d attempts: %s", d.message.Title, d.attempt, err.Error()))
+		return
+	}
+	// exponential backoff without blocking other deliveries
+	time.AfterFunc(time.Duration(1<<d.attempt)*time.Second, func() {
+		enqueue(d)
+	})
+}
+
+func enqueue(d *delivery) {
+	start()
+	select {
+	case queue <- d:
+	default:
+		common.SysError("notification queue is full, dropping notification: " + d.message.Title)
+	}
+}
+
+// Send delivers the event to every sink subscribed to it in the background,
+// falls back to the email of the root user if no sink is subscribed
+func Send(event string, title string, content string) {
+	message := &Message{
+		Event:     event,
+		Title:     title,
+		Content:   content,
+		Timestamp: common.GetTimestamp(),
+	}
+	sinksLock.RLock()
+	sent := sendToSinks(sinks, message)
+	sinksLock.RUnlock()
+	if !sent {
+		enqueue(&delivery{notifier: &EmailNotifier{}, message: message})
+	}
+}
+
+// SendToSinks delivers the event to every given sink subscribed to it in the background, e.g. to the sinks of a user,
+// returns false if no sink is subscribed
+func SendToSinks(sinks []*Sink, event string, title string, content string) bool {
+	return sendToSinks(sinks, &Message{
+		Event:     event,
+		Title:     title,
+		Content:   content,
+		Timestamp: common.GetTimestamp(),
+	})
+}
+
+func sendToSinks(sinks []*Sink, message *Message) bool {
+	sent := false
+	for _, sink := range sinks {
+		if !sink.accepts(message.Event) {
+			continue
+		}
+		notifier, err := sink.notifier()
+		if err != nil {
+			common.SysError(err.Error())
+			continue
+		}
+		enqueue(&delivery{notifier: notifier, message: message})
+		sent = true
+	}
+	return sent
+}
+
+// SendTo delivers the message with the given notifier in the background, e.g. to the email of a user
+func SendTo(notifier Notifier, event string, title string, content string) {
+	enqueue(&delivery{notifier: notifier, message: &Message{
+		Event:     event,
+		Title:     title,
+		Content:   content,
+		Timestamp: common.GetTimestamp(),
+	}})
+}
@@ -0,0 +1,41 @@
+package notify
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseUserSinksRejectsInternalHosts(t *testing.T) {
+	for _, rawURL := range []string{
+		"http://127.0.0.1:3000/api/user/self",
+		"http://10.0.0.1/hook",
+		"http://169.254.169.254/latest/meta-data/",
+		"http://[::1]/hook",
+		"http://localhost/hook",
+	} {
+		_, err := ParseUserSinks(`[{"name":"hook","type":"webhook","url":"` + rawURL + `","events":["*"]}]`)
+		if err == nil {
+			t.Errorf("%s should be rejected", rawURL)
+		}
+	}
+	sinks, err := ParseUserSinks(`[{"name":"mail","type":"email","events":["*"]}]`)
+	if err != nil || len(sinks) != 1 {
+		t.Errorf("sinks = %v, err = %v, want the email sink accepted", sinks, err)
+	}
+}
+
+func TestPublicHTTPClientRefusesInternalAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	// a sink which passed the check when it was saved but whose host resolves to the loopback now
+	sink := &Sink{Name: "hook", Type: SinkTypeWebhook, URL: server.URL, Events: []string{"*"}, publicOnly: true}
+	notifier, err := sink.notifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = notifier.Notify(&Message{Event: EventBudgetAlert, Title: "title", Content: "content"})
+	if err == nil {
+		t.Error("the notifier of a user sink should not connect to the loopback")
+	}
+}
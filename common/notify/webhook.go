@@ -0,0 +1,240 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"one-api/common"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// publicHTTPClient is used for the sinks set by users, every address it dials is checked after the name is resolved
+// so the host can't be pointed to the internal network after the sink was saved, the proxy is skipped for the same reason
+var publicHTTPClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(network string, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				ip := net.ParseIP(host)
+				if ip == nil || !common.IsPublicIP(ip) {
+					return fmt.Errorf("the address %s is not public", host)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+// checkPublicURL resolves the host of the url and rejects it if any of its addresses is not public
+func checkPublicURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	ips, err := net.LookupIP(u.Hostname())
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if !common.IsPublicIP(ip) {
+			return fmt.Errorf("the host %s resolves to %s which is not public", u.Hostname(), ip.String())
+		}
+	}
+	return nil
+}
+
+func postJSON(client *http.Client, webhookURL string, payload any) ([]byte, error) {
+	jsonData, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", webhookURL, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("status code %d: %s", resp.StatusCode, string(body))
+	}
+	return body, nil
+}
+
+// SignPayload returns the hex HMAC-SHA256 of "timestamp.payload", receivers should verify it
+// and reject old timestamps to prevent replays
+func SignPayload(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookNotifier posts the message as JSON, signed with the secret in the X-OneAPI-Signature header
+type webhookNotifier struct {
+	client *http.Client
+	url    string
+	secret string
+}
+
+func (n *webhookNotifier) Notify(message *Message) error {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", n.url, bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.secret != "" {
+		timestamp := common.GetTimestamp()
+		req.Header.Set("X-OneAPI-Timestamp", strconv.FormatInt(timestamp, 10))
+		req.Header.Set("X-OneAPI-Signature", SignPayload(n.secret, timestamp, payload))
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// https://api.slack.com/messaging/webhooks
+type slackNotifier struct {
+	client *http.Client
+	url    string
+}
+
+func (n *slackNotifier) Notify(message *Message) error {
+	_, err := postJSON(n.client, n.url, map[string]any{
+		"text": fmt.Sprintf("*%s*\n%s", message.Title, message.Content),
+	})
+	return err
+}
+
+type imWebhookResponse struct {
+	ErrCode int    `json:"errcode"`
+	ErrMsg  string `json:"errmsg"`
+	Code    int    `json:"code"`
+	Msg     string `json:"msg"`
+}
+
+func checkIMWebhookResponse(body []byte) error {
+	var response imWebhookResponse
+	err := json.Unmarshal(body, &response)
+	if err != nil {
+		return err
+	}
+	if response.ErrCode != 0 {
+		return fmt.Errorf("error %d: %s", response.ErrCode, response.ErrMsg)
+	}
+	if response.Code != 0 {
+		return fmt.Errorf("error %d: %s", response.Code, response.Msg)
+	}
+	return nil
+}
+
+// https://open.dingtalk.com/document/robots/custom-robot-access
+type dingTalkNotifier struct {
+	client *http.Client
+	url    string
+	secret string
+}
+
+func (n *dingTalkNotifier) Notify(message *Message) error {
+	webhookURL := n.url
+	if n.secret != "" {
+		timestamp := time.Now().UnixMilli()
+		mac := hmac.New(sha256.New, []byte(n.secret))
+		mac.Write([]byte(fmt.Sprintf("%d\n%s", timestamp, n.secret)))
+		sign := url.QueryEscape(base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+		webhookURL = fmt.Sprintf("%s&timestamp=%d&sign=%s", webhookURL, timestamp, sign)
+	}
+	body, err := postJSON(n.client, webhookURL, map[string]any{
+		"msgtype": "markdown",
+		"markdown": map[string]string{
+			"title": message.Title,
+			"text":  fmt.Sprintf("### %s\n%s", message.Title, message.Content),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return checkIMWebhookResponse(body)
+}
+
+// https://open.feishu.cn/document/client-docs/bot-v3/add-custom-bot
+type feishuNotifier struct {
+	client *http.Client
+	url    string
+	secret string
+}
+
+func (n *feishuNotifier) Notify(message *Message) error {
+	payload := map[string]any{
+		"msg_type": "text",
+		"content": map[string]string{
+			"text": fmt.Sprintf("%s\n%s", message.Title, message.Content),
+		},
+	}
+	if n.secret != "" {
+		timestamp := common.GetTimestamp()
+		mac := hmac.New(sha256.New, []byte(fmt.Sprintf("%d\n%s", timestamp, n.secret)))
+		payload["timestamp"] = strconv.FormatInt(timestamp, 10)
+		payload["sign"] = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	}
+	body, err := postJSON(n.client, n.url, payload)
+	if err != nil {
+		return err
+	}
+	return checkIMWebhookResponse(body)
+}
+
+// https://developer.work.weixin.qq.com/document/path/91770
+type weComNotifier struct {
+	client *http.Client
+	url    string
+}
+
+func (n *weComNotifier) Notify(message *Message) error {
+	body, err := postJSON(n.client, n.url, map[string]any{
+		"msgtype": "markdown",
+		"markdown": map[string]string{
+			"content": fmt.Sprintf("### %s\n%s", message.Title, message.Content),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return checkIMWebhookResponse(body)
+}
@@ -0,0 +1,61 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	RoutingStrategyRandom        = "random"
+	RoutingStrategyWeighted      = "weighted"
+	RoutingStrategyLatency       = "latency"
+	RoutingStrategyCost          = "cost"
+	RoutingStrategyLeastInFlight = "least_in_flight"
+)
+
+const (
+	ChannelAffinityModeNone  = ""
+	ChannelAffinityModeUser  = "user"
+	ChannelAffinityModeToken = "token"
+)
+
+// ChannelAffinityMode makes requests of the same user or token and model stick to the same channel
+var ChannelAffinityMode = ChannelAffinityModeNone
+
+// GroupRoutingStrategy is the channel selection strategy of each group, groups not listed use random
+var GroupRoutingStrategy = map[string]string{
+	"default": RoutingStrategyRandom,
+}
+
+func GroupRoutingStrategy2JSONString() string {
+	jsonBytes, err := json.Marshal(GroupRoutingStrategy)
+	if err != nil {
+		SysError("Error marshalling group routing strategy: " + err.Error())
+	}
+	return string(jsonBytes)
+}
+
+func UpdateGroupRoutingStrategyByJSONString(jsonStr string) error {
+	groupRoutingStrategy := make(map[string]string)
+	err := json.Unmarshal([]byte(jsonStr), &groupRoutingStrategy)
+	if err != nil {
+		return err
+	}
+	for group, strategy := range groupRoutingStrategy {
+		switch strategy {
+		case RoutingStrategyRandom, RoutingStrategyWeighted, RoutingStrategyLatency, RoutingStrategyCost, RoutingStrategyLeastInFlight:
+		default:
+			return fmt.Errorf("unknown routing strategy %s of group %s", strategy, group)
+		}
+	}
+	GroupRoutingStrategy = groupRoutingStrategy
+	return nil
+}
+
+func GetGroupRoutingStrategy(group string) string {
+	strategy, ok := GroupRoutingStrategy[group]
+	if !ok || strategy == "" {
+		return RoutingStrategyRandom
+	}
+	return strategy
+}
@@ -0,0 +1,171 @@
+package common
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"os"
+	"strings"
+)
+
+// Secrets are encrypted with a random data key (DEK), the data key itself is stored in the
+// database wrapped by the master key, so rotating the master key only re-wraps the data key.
+
+const secretPrefix = "enc:v1:"
+
+var secretAEAD cipher.AEAD
+var secretMACKey []byte
+
+func deriveKey(secret string) []byte {
+	key := sha256.Sum256([]byte(secret))
+	return key[:]
+}
+
+func readMasterKey(envName string, fileEnvName string) ([]byte, error) {
+	if key := os.Getenv(envName); key != "" {
+		return deriveKey(key), nil
+	}
+	if path := os.Getenv(fileEnvName); path != "" {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		key := strings.TrimSpace(string(content))
+		if key == "" {
+			return nil, errors.New(fileEnvName + " is empty")
+		}
+		return deriveKey(key), nil
+	}
+	return nil, nil
+}
+
+// GetMasterKey returns the master key from MASTER_KEY or MASTER_KEY_FILE, nil means not set
+func GetMasterKey() ([]byte, error) {
+	return readMasterKey("MASTER_KEY", "MASTER_KEY_FILE")
+}
+
+// GetNewMasterKey returns the master key to rotate to from NEW_MASTER_KEY or NEW_MASTER_KEY_FILE
+func GetNewMasterKey() ([]byte, error) {
+	return readMasterKey("NEW_MASTER_KEY", "NEW_MASTER_KEY_FILE")
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func sealSecret(aead cipher.AEAD, nonce []byte, plaintext []byte) string {
+	ciphertext := aead.Seal(nonce, nonce, plaintext, nil)
+	return base64.StdEncoding.EncodeToString(ciphertext)
+}
+
+func openSecret(aead cipher.AEAD, value string) ([]byte, error) {
+	ciphertext, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
+
+func GenerateDataKey() ([]byte, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	return key, err
+}
+
+func WrapDataKey(masterKey []byte, dataKey []byte) (string, error) {
+	aead, err := newAEAD(masterKey)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	return sealSecret(aead, nonce, dataKey), nil
+}
+
+func UnwrapDataKey(masterKey []byte, wrappedDataKey string) ([]byte, error) {
+	aead, err := newAEAD(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := openSecret(aead, wrappedDataKey)
+	if err != nil {
+		return nil, errors.New("failed to unwrap the data key, the master key may be wrong")
+	}
+	return dataKey, nil
+}
+
+// SetDataKey enables the encryption of secrets with the given data key
+func SetDataKey(dataKey []byte) error {
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, dataKey)
+	mac.Write([]byte("deterministic-nonce"))
+	secretAEAD = aead
+	secretMACKey = mac.Sum(nil)
+	return nil
+}
+
+func SecretEncryptionEnabled() bool {
+	return secretAEAD != nil
+}
+
+func IsEncryptedSecret(value string) bool {
+	return strings.HasPrefix(value, secretPrefix)
+}
+
+// EncryptSecret encrypts the value with a random nonce, the value is returned as is if encryption is disabled
+func EncryptSecret(value string) (string, error) {
+	if secretAEAD == nil || value == "" || IsEncryptedSecret(value) {
+		return value, nil
+	}
+	nonce := make([]byte, secretAEAD.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	return secretPrefix + sealSecret(secretAEAD, nonce, []byte(value)), nil
+}
+
+// EncryptSecretDeterministic derives the nonce from the value (SIV-like),
+// so equal values have equal ciphertexts and the column can still be used for lookups
+func EncryptSecretDeterministic(value string) string {
+	if secretAEAD == nil || value == "" || IsEncryptedSecret(value) {
+		return value
+	}
+	mac := hmac.New(sha256.New, secretMACKey)
+	mac.Write([]byte(value))
+	nonce := mac.Sum(nil)[:secretAEAD.NonceSize()]
+	return secretPrefix + sealSecret(secretAEAD, nonce, []byte(value))
+}
+
+// DecryptSecret decrypts the value, plaintext values which are not migrated yet are returned as is
+func DecryptSecret(value string) (string, error) {
+	if !IsEncryptedSecret(value) {
+		return value, nil
+	}
+	if secretAEAD == nil {
+		return "", errors.New("the secret is encrypted but MASTER_KEY is not set")
+	}
+	plaintext, err := openSecret(secretAEAD, strings.TrimPrefix(value, secretPrefix))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
@@ -0,0 +1,145 @@
+package common
+
+import (
+	"strings"
+	"testing"
+)
+
+func setTestDataKey(t *testing.T) []byte {
+	dataKey, err := GenerateDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = SetDataKey(dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		secretAEAD = nil
+		secretMACKey = nil
+	})
+	return dataKey
+}
+
+func TestEncryptSecretRoundTrip(t *testing.T) {
+	setTestDataKey(t)
+	encrypted, err := EncryptSecret("sk-upstream-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncryptedSecret(encrypted) || strings.Contains(encrypted, "sk-upstream-key") {
+		t.Fatalf("the secret is not encrypted: %s", encrypted)
+	}
+	again, err := EncryptSecret("sk-upstream-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == encrypted {
+		t.Error("the ciphertexts of the same value should differ with random nonces")
+	}
+	decrypted, err := DecryptSecret(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted != "sk-upstream-key" {
+		t.Errorf("decrypted = %q, want %q", decrypted, "sk-upstream-key")
+	}
+	// encrypting twice must not wrap the ciphertext again
+	twice, err := EncryptSecret(encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if twice != encrypted {
+		t.Error("an encrypted value should be returned as is")
+	}
+}
+
+func TestEncryptSecretDeterministic(t *testing.T) {
+	setTestDataKey(t)
+	a := EncryptSecretDeterministic("access-token")
+	b := EncryptSecretDeterministic("access-token")
+	c := EncryptSecretDeterministic("another-token")
+	if a != b {
+		t.Error("equal values should have equal ciphertexts")
+	}
+	if a == c {
+		t.Error("different values should have different ciphertexts")
+	}
+	decrypted, err := DecryptSecret(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted != "access-token" {
+		t.Errorf("decrypted = %q, want %q", decrypted, "access-token")
+	}
+}
+
+func TestSecretsWithoutDataKey(t *testing.T) {
+	encrypted, err := EncryptSecret("plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encrypted != "plain" || EncryptSecretDeterministic("plain") != "plain" {
+		t.Error("the values should be kept as is when encryption is disabled")
+	}
+	decrypted, err := DecryptSecret("plain")
+	if err != nil || decrypted != "plain" {
+		t.Errorf("decrypted = %q, %v, want the plaintext as is", decrypted, err)
+	}
+	_, err = DecryptSecret(secretPrefix + "AAAA")
+	if err == nil {
+		t.Error("decrypting without the data key should fail")
+	}
+}
+
+func TestDecryptSecretWithAnotherDataKey(t *testing.T) {
+	setTestDataKey(t)
+	encrypted, err := EncryptSecret("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setTestDataKey(t)
+	_, err = DecryptSecret(encrypted)
+	if err == nil {
+		t.Error("decrypting with another data key should fail")
+	}
+}
+
+func TestWrapDataKeyRoundTrip(t *testing.T) {
+	masterKey := deriveKey("master")
+	dataKey, err := GenerateDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := WrapDataKey(masterKey, dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unwrapped, err := UnwrapDataKey(masterKey, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(unwrapped) != string(dataKey) {
+		t.Error("the unwrapped data key differs from the original one")
+	}
+	_, err = UnwrapDataKey(deriveKey("wrong"), wrapped)
+	if err == nil {
+		t.Error("unwrapping with a wrong master key should fail")
+	}
+}
+
+func TestReadMasterKey(t *testing.T) {
+	t.Setenv("MASTER_KEY", "from-env")
+	key, err := GetMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(key) != string(deriveKey("from-env")) {
+		t.Error("the master key should be derived from MASTER_KEY")
+	}
+	t.Setenv("NEW_MASTER_KEY", "")
+	key, err = GetNewMasterKey()
+	if err != nil || key != nil {
+		t.Errorf("key = %v, err = %v, want nil when NEW_MASTER_KEY is not set", key, err)
+	}
+}
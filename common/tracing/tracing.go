@@ -0,0 +1,76 @@
+package tracing
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"one-api/common"
+	"os"
+)
+
+// Tracer is a no-op until InitTracing installs a tracer provider
+var Tracer = otel.Tracer("one-api")
+
+// InitTracing exports spans with OTLP/HTTP if OTEL_EXPORTER_OTLP_ENDPOINT or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT is set,
+// the exporter, sampler and service name are configured by the standard OTEL_* environment variables.
+// The returned function flushes the pending spans.
+func InitTracing() (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	noop := func(context.Context) error { return nil }
+	if os.Getenv("OTEL_TRACES_EXPORTER") == "none" ||
+		(os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "") {
+		return noop, nil
+	}
+	exporter, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		return noop, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceVersion(common.Version)))
+	if err != nil {
+		return noop, err
+	}
+	if os.Getenv("OTEL_SERVICE_NAME") == "" {
+		res, err = resource.Merge(res, resource.NewSchemaless(semconv.ServiceName("one-api")))
+		if err != nil {
+			return noop, err
+		}
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	common.SysLog("OpenTelemetry tracing enabled")
+	return provider.Shutdown, nil
+}
+
+// StartSpan starts a child span of the request span, the context of the request is not changed
+func StartSpan(c *gin.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return Tracer.Start(c.Request.Context(), name, trace.WithAttributes(attributes...))
+}
+
+// EndSpan ends the span, marks it as failed if the request was aborted.
+// It is safe to call it more than once, only the first call takes effect.
+func EndSpan(c *gin.Context, span trace.Span) {
+	if c.IsAborted() {
+		span.SetStatus(codes.Error, "aborted")
+	}
+	span.End()
+}
+
+// RecordError marks the span as failed
+func RecordError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// Inject propagates the span of the context to the outgoing request with the W3C traceparent header
+func Inject(ctx context.Context, header http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
@@ -8,6 +8,7 @@ import (
 	"math/rand"
 	"net"
 	"os/exec"
+	"path"
 	"runtime"
 	"strconv"
 	"strings"
@@ -168,3 +169,59 @@ func Max(a int, b int) int {
 		return b
 	}
 }
+
+// ValidateModelPatterns checks a comma separated list of model patterns, e.g. "gpt-3.5*,gpt-4"
+func ValidateModelPatterns(patterns string) error {
+	for _, pattern := range strings.Split(patterns, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("无效的模型匹配规则：%s", pattern)
+		}
+	}
+	return nil
+}
+
+// IsModelAllowed reports whether the model matches one of the comma separated patterns.
+// Empty patterns means no restriction.
+func IsModelAllowed(patterns string, model string) bool {
+	if strings.TrimSpace(patterns) == "" {
+		return true
+	}
+	for _, pattern := range strings.Split(patterns, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if matched, _ := path.Match(pattern, model); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func IsValidQuotaPeriod(period string) bool {
+	switch period {
+	case TokenQuotaPeriodNone, TokenQuotaPeriodDaily, TokenQuotaPeriodWeekly, TokenQuotaPeriodMonthly:
+		return true
+	}
+	return false
+}
+
+// GetQuotaPeriodStart returns the start of the period containing t in local time,
+// weeks start on Monday, 0 means no period
+func GetQuotaPeriodStart(period string, t time.Time) int64 {
+	year, month, day := t.Date()
+	switch period {
+	case TokenQuotaPeriodDaily:
+		return time.Date(year, month, day, 0, 0, 0, 0, t.Location()).Unix()
+	case TokenQuotaPeriodWeekly:
+		offset := (int(t.Weekday()) + 6) % 7
+		return time.Date(year, month, day-offset, 0, 0, 0, 0, t.Location()).Unix()
+	case TokenQuotaPeriodMonthly:
+		return time.Date(year, month, 1, 0, 0, 0, 0, t.Location()).Unix()
+	}
+	return 0
+}
@@ -2,6 +2,7 @@ package controller
 
 import (
 	"github.com/gin-gonic/gin"
+	"one-api/common"
 	"one-api/model"
 )
 
@@ -10,7 +11,7 @@ func GetSubscription(c *gin.Context) {
 	quota, err := model.GetUserQuota(userId)
 	if err != nil {
 		openAIError := OpenAIError{
-			Message: err.Error(),
+			Message: common.MessageWithRequestId(c, err.Error()),
 			Type:    "one_api_error",
 		}
 		c.JSON(200, gin.H{
@@ -37,7 +37,40 @@ type OpenAIUsageResponse struct {
 	TotalUsage float64 `json:"total_usage"` // unit: 0.01 dollar
 }
 
+// updateChannelBalance updates the balance of every key of the channel,
+// the balance of the channel is the sum of its enabled keys
 func updateChannelBalance(channel *model.Channel) (float64, error) {
+	keys, err := model.GetChannelKeys(channel.Id, true)
+	if err != nil {
+		return 0, err
+	}
+	if len(keys) == 0 {
+		return 0, errors.New("渠道没有密钥")
+	}
+	balance := 0.0
+	for _, key := range keys {
+		keyBalance, err := getChannelKeyBalance(channel, key.Key)
+		if err != nil {
+			return 0, err
+		}
+		key.UpdateBalance(keyBalance)
+		if key.Status != common.ChannelKeyStatusEnabled {
+			continue
+		}
+		if keyBalance <= 0 {
+			err = model.UpdateChannelKeyStatus(key.Id, common.ChannelKeyStatusDisabled, "余额不足")
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
+		balance += keyBalance
+	}
+	channel.UpdateBalance(balance)
+	return balance, nil
+}
+
+func getChannelKeyBalance(channel *model.Channel, key string) (float64, error) {
 	baseURL := common.ChannelBaseURLs[channel.Type]
 	switch channel.Type {
 	case common.ChannelTypeOpenAI:
@@ -56,7 +89,7 @@ func updateChannelBalance(channel *model.Channel) (float64, error) {
 	if err != nil {
 		return 0, err
 	}
-	auth := fmt.Sprintf("Bearer %s", channel.Key)
+	auth := fmt.Sprintf("Bearer %s", key)
 	req.Header.Add("Authorization", auth)
 	res, err := client.Do(req)
 	if err != nil {
@@ -105,7 +138,6 @@ func updateChannelBalance(channel *model.Channel) (float64, error) {
 		return 0, err
 	}
 	balance := subscription.HardLimitUSD - usage.TotalUsage/100
-	channel.UpdateBalance(balance)
 	return balance, nil
 }
 
@@ -161,7 +193,7 @@ func updateAllChannelsBalance() error {
 		} else {
 			// err is nil & balance <= 0 means quota is used up
 			if balance <= 0 {
-				disableChannel(channel.Id, channel.Name, "余额不足")
+				recordChannelFailure(channel.Id, channel.Name, "余额不足")
 			}
 		}
 	}
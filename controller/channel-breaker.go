@@ -0,0 +1,213 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"one-api/common"
+	"one-api/model"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A circuit breaker per channel:
+// closed -> open: ChannelBreakerFailureThreshold failures within ChannelBreakerWindow, the channel is auto disabled
+// open -> half-open: after ChannelBreakerCooldown, the channel is probed with a test request
+// half-open -> closed: the probe succeeds, the channel is enabled again
+// half-open -> open: the probe fails, wait for another cooldown
+// Channels disabled by admin are never touched.
+
+const (
+	breakerStateClosed = iota
+	breakerStateOpen
+	breakerStateHalfOpen
+)
+
+type channelBreaker struct {
+	state    int
+	failures []int64 // timestamps of recent failures, unit: second
+}
+
+var channelBreakers = make(map[int]*channelBreaker)
+var channelBreakersLock sync.Mutex
+
+func getChannelBreaker(channelId int) *channelBreaker {
+	breaker, ok := channelBreakers[channelId]
+	if !ok {
+		breaker = &channelBreaker{state: breakerStateClosed}
+		channelBreakers[channelId] = breaker
+	}
+	return breaker
+}
+
+func shouldDisableChannelKey(err *OpenAIErrorWithStatusCode) bool {
+	return err.Type == "insufficient_quota" || err.Code == "invalid_api_key"
+}
+
+// disableChannelKey disables a single key of the channel, returns true if the channel still has enabled keys
+func disableChannelKey(channelId int, keyId int, reason string) bool {
+	if keyId == 0 {
+		return false
+	}
+	err := model.UpdateChannelKeyStatus(keyId, common.ChannelKeyStatusDisabled, reason)
+	if err != nil {
+		common.SysError(fmt.Sprintf("failed to disable key #%d of channel #%d: %s", keyId, channelId, err.Error()))
+		return false
+	}
+	common.SysLog(fmt.Sprintf("key #%d of channel #%d has been disabled: %s", keyId, channelId, reason))
+	count, err := model.CountEnabledChannelKeys(channelId)
+	if err != nil {
+		return false
+	}
+	return count > 0
+}
+
+func shouldCountChannelFailure(err *OpenAIErrorWithStatusCode) bool {
+	// https://platform.openai.com/docs/guides/error-codes/api-errors
+	if shouldDisableChannelKey(err) {
+		return true
+	}
+	return err.StatusCode >= 500 || err.Code == "do_request_failed"
+}
+
+func recordChannelFailure(channelId int, channelName string, reason string) {
+	if !common.AutomaticDisableChannelEnabled {
+		return
+	}
+	channelBreakersLock.Lock()
+	breaker := getChannelBreaker(channelId)
+	if breaker.state != breakerStateClosed {
+		channelBreakersLock.Unlock()
+		return
+	}
+	now := common.GetTimestamp()
+	failures := make([]int64, 0, len(breaker.failures)+1)
+	for _, failure := range breaker.failures {
+		if now-failure < int64(common.ChannelBreakerWindow) {
+			failures = append(failures, failure)
+		}
+	}
+	breaker.failures = append(failures, now)
+	shouldOpen := len(breaker.failures) >= common.ChannelBreakerFailureThreshold
+	if shouldOpen {
+		breaker.state = breakerStateOpen
+		breaker.failures = nil
+	}
+	channelBreakersLock.Unlock()
+	if shouldOpen {
+		disableChannel(channelId, channelName, reason)
+		scheduleChannelProbe(channelId)
+	}
+}
+
+func recordChannelSuccess(channelId int) {
+	channelBreakersLock.Lock()
+	defer channelBreakersLock.Unlock()
+	breaker, ok := channelBreakers[channelId]
+	if ok && breaker.state == breakerStateClosed {
+		breaker.failures = nil
+	}
+}
+
+// resetChannelBreaker is called when admin changes the status of the channel
+func resetChannelBreaker(channelId int) {
+	channelBreakersLock.Lock()
+	defer channelBreakersLock.Unlock()
+	delete(channelBreakers, channelId)
+}
+
+func scheduleChannelProbe(channelId int) {
+	time.AfterFunc(time.Duration(common.ChannelBreakerCooldown)*time.Second, func() {
+		probeChannel(channelId)
+	})
+}
+
+func probeChannel(channelId int) {
+	channelBreakersLock.Lock()
+	breaker, ok := channelBreakers[channelId]
+	if !ok || breaker.state != breakerStateOpen {
+		channelBreakersLock.Unlock()
+		return
+	}
+	breaker.state = breakerStateHalfOpen
+	channelBreakersLock.Unlock()
+
+	channel, err := model.GetChannelById(channelId, true)
+	if err != nil || channel.Status != common.ChannelStatusAutoDisabled {
+		// deleted or changed by admin
+		resetChannelBreaker(channelId)
+		return
+	}
+	count, err := model.CountEnabledChannelKeys(channelId)
+	if err == nil && count == 0 {
+		// the probe can't succeed until a key is enabled again, which resumes probing
+		common.SysLog(fmt.Sprintf("channel #%d has no enabled key, stopped probing", channelId))
+		resetChannelBreaker(channelId)
+		return
+	}
+	// probe with the first model which can be tested, the breaker stays open if there is none
+	err = errors.New("没有可用于探测的模型")
+	var milliseconds int64
+	for _, m := range strings.Split(channel.Models, ",") {
+		m = strings.TrimSpace(m)
+		if m == "" {
+			continue
+		}
+		tik := time.Now()
+		skipped, testErr := testChannelModel(channel, m)
+		if skipped {
+			continue
+		}
+		milliseconds = time.Since(tik).Milliseconds()
+		channel.UpdateResponseTime(milliseconds)
+		err = testErr
+		break
+	}
+	if err == nil && milliseconds > int64(common.ChannelDisableThreshold*1000) && common.ChannelDisableThreshold > 0 {
+		err = errors.New(fmt.Sprintf("响应时间 %.2fs 超过阈值 %.2fs", float64(milliseconds)/1000.0, common.ChannelDisableThreshold))
+	}
+	if err != nil {
+		common.SysLog(fmt.Sprintf("channel #%d is still unavailable: %s", channelId, err.Error()))
+		channelBreakersLock.Lock()
+		breaker.state = breakerStateOpen
+		channelBreakersLock.Unlock()
+		scheduleChannelProbe(channelId)
+		return
+	}
+	resetChannelBreaker(channelId)
+	enableChannel(channelId, channel.Name)
+}
+
+// resumeChannelProbe probes the auto disabled channel again if it's not being probed, e.g. after a key of it is enabled
+func resumeChannelProbe(channelId int) {
+	channel, err := model.GetChannelById(channelId, false)
+	if err != nil || channel.Status != common.ChannelStatusAutoDisabled {
+		return
+	}
+	channelBreakersLock.Lock()
+	breaker := getChannelBreaker(channelId)
+	if breaker.state != breakerStateClosed {
+		channelBreakersLock.Unlock()
+		return
+	}
+	breaker.state = breakerStateOpen
+	channelBreakersLock.Unlock()
+	scheduleChannelProbe(channelId)
+}
+
+// InitChannelBreakers resumes probing the channels auto disabled before restart
+func InitChannelBreakers() {
+	channels, err := model.GetChannelsByStatus(common.ChannelStatusAutoDisabled)
+	if err != nil {
+		common.SysError("failed to get auto disabled channels: " + err.Error())
+		return
+	}
+	channelBreakersLock.Lock()
+	for _, channel := range channels {
+		getChannelBreaker(channel.Id).state = breakerStateOpen
+	}
+	channelBreakersLock.Unlock()
+	for _, channel := range channels {
+		scheduleChannelProbe(channel.Id)
+	}
+}
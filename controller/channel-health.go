@@ -0,0 +1,88 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"one-api/common"
+	"one-api/model"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseWindow parses durations like "30m", "1h", and "7d" which is not supported by time.ParseDuration
+func parseWindow(window string) (time.Duration, error) {
+	if strings.HasSuffix(window, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(window, "d"))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(window)
+}
+
+func GetChannelLatencyStats(c *gin.Context) {
+	channelId, _ := strconv.Atoi(c.Query("channel_id"))
+	model_ := c.Query("model")
+	windows := c.Query("windows")
+	if windows == "" {
+		windows = "1h,24h"
+	}
+	data := make(map[string][]*model.ChannelLatencyStat)
+	for _, window := range strings.Split(windows, ",") {
+		window = strings.TrimSpace(window)
+		duration, err := parseWindow(window)
+		if err != nil || duration <= 0 {
+			c.JSON(http.StatusOK, gin.H{
+				"success": false,
+				"message": "无效的时间窗口：" + window,
+			})
+			return
+		}
+		stats, err := model.GetChannelLatencyStats(channelId, model_, common.GetTimestamp()-int64(duration.Seconds()))
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"success": false,
+				"message": err.Error(),
+			})
+			return
+		}
+		data[window] = stats
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    data,
+	})
+	return
+}
+
+func GetChannelHealthHistory(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	p, _ := strconv.Atoi(c.Query("p"))
+	if p < 0 {
+		p = 0
+	}
+	histories, err := model.GetChannelHealthHistory(id, p*common.ItemsPerPage, common.ItemsPerPage)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    histories,
+	})
+	return
+}
@@ -8,12 +8,26 @@ import (
 	"github.com/gin-gonic/gin"
 	"net/http"
 	"one-api/common"
+	"one-api/common/notify"
 	"one-api/model"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
+type ChannelTestResult struct {
+	Model        string `json:"model"`
+	Success      bool   `json:"success"`
+	Message      string `json:"message"`
+	ResponseTime int64  `json:"response_time"` // in milliseconds
+	TestTime     int64  `json:"test_time"`
+}
+
+// the latest test results of each channel, keyed by channel id and then model
+var channelTestResults = make(map[int]map[string]*ChannelTestResult)
+var channelTestResultsLock sync.RWMutex
+
 func testChannel(channel *model.Channel, request *ChatRequest) error {
 	if request.Model == "" {
 		request.Model = "gpt-3.5-turbo"
@@ -21,49 +35,110 @@ func testChannel(channel *model.Channel, request *ChatRequest) error {
 			request.Model = "gpt-35-turbo"
 		}
 	}
+	response, err := doChannelTestRequest(channel, "/v1/chat/completions", request.Model, request)
+	if err != nil {
+		return err
+	}
+	if response.Usage.CompletionTokens == 0 {
+		return errors.New(fmt.Sprintf("type %s, code %s, message %s", response.Error.Type, response.Error.Code, response.Error.Message))
+	}
+	return nil
+}
+
+// channelTestTimeout bounds a test request so a hanging upstream can't hold the test forever,
+// a response slower than the disable threshold fails the test anyway
+func channelTestTimeout() time.Duration {
+	timeout := 60 * time.Second
+	threshold := time.Duration(common.ChannelDisableThreshold * float64(time.Second))
+	if threshold > 0 && threshold+time.Second < timeout {
+		timeout = threshold + time.Second
+	}
+	return timeout
+}
+
+func doChannelTestRequest(channel *model.Channel, path string, model_ string, request any) (*TextResponse, error) {
 	requestURL := common.ChannelBaseURLs[channel.Type]
 	if channel.Type == common.ChannelTypeAzure {
-		requestURL = fmt.Sprintf("%s/openai/deployments/%s/chat/completions?api-version=2023-03-15-preview", channel.BaseURL, request.Model)
+		// same as relayHelper
+		model_ = strings.Replace(model_, ".", "", -1)
+		requestURL = fmt.Sprintf("%s/openai/deployments/%s/%s?api-version=2023-03-15-preview", channel.BaseURL, model_, strings.TrimPrefix(path, "/v1/"))
 	} else {
 		if channel.Type == common.ChannelTypeCustom {
 			requestURL = channel.BaseURL
 		}
-		requestURL += "/v1/chat/completions"
+		requestURL += path
 	}
 
 	jsonData, err := json.Marshal(request)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	req, err := http.NewRequest("POST", requestURL, bytes.NewBuffer(jsonData))
 	if err != nil {
-		return err
+		return nil, err
+	}
+	channelKey, err := channel.PeekKey()
+	if err != nil {
+		return nil, err
 	}
 	if channel.Type == common.ChannelTypeAzure {
-		req.Header.Set("api-key", channel.Key)
+		req.Header.Set("api-key", channelKey.Key)
 	} else {
-		req.Header.Set("Authorization", "Bearer "+channel.Key)
+		req.Header.Set("Authorization", "Bearer "+channelKey.Key)
 	}
 	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{}
+	client := &http.Client{Timeout: channelTestTimeout()}
 	resp, err := client.Do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
 	var response TextResponse
 	err = json.NewDecoder(resp.Body).Decode(&response)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if response.Usage.CompletionTokens == 0 {
-		return errors.New(fmt.Sprintf("type %s, code %s, message %s", response.Error.Type, response.Error.Code, response.Error.Message))
+	return &response, nil
+}
+
+// testChannelModel tests the model with the endpoint it belongs to,
+// returns skipped = true for the models not supported by the relay (e.g. audio, moderations).
+func testChannelModel(channel *model.Channel, model_ string) (skipped bool, err error) {
+	switch {
+	case strings.HasPrefix(model_, "gpt-") || strings.Contains(model_, "turbo"):
+		return false, testChannel(channel, buildTestRequest(model_))
+	case strings.Contains(model_, "embedding"):
+		response, err := doChannelTestRequest(channel, "/v1/embeddings", model_, gin.H{
+			"model": model_,
+			"input": "hi",
+		})
+		if err != nil {
+			return false, err
+		}
+		if response.Usage.PromptTokens == 0 {
+			return false, errors.New(fmt.Sprintf("type %s, code %s, message %s", response.Error.Type, response.Error.Code, response.Error.Message))
+		}
+		return false, nil
+	case strings.HasPrefix(model_, "whisper") || strings.Contains(model_, "moderation") ||
+		strings.Contains(model_, "edit") || strings.Contains(model_, "search"):
+		return true, nil
+	default:
+		response, err := doChannelTestRequest(channel, "/v1/completions", model_, gin.H{
+			"model":      model_,
+			"prompt":     "hi",
+			"max_tokens": 1,
+		})
+		if err != nil {
+			return false, err
+		}
+		if response.Usage.CompletionTokens == 0 {
+			return false, errors.New(fmt.Sprintf("type %s, code %s, message %s", response.Error.Type, response.Error.Code, response.Error.Message))
+		}
+		return false, nil
 	}
-	return nil
 }
 
-func buildTestRequest(c *gin.Context) *ChatRequest {
-	model_ := c.Query("model")
+func buildTestRequest(model_ string) *ChatRequest {
 	testRequest := &ChatRequest{
 		Model:     model_,
 		MaxTokens: 1,
@@ -93,9 +168,12 @@ func TestChannel(c *gin.Context) {
 		})
 		return
 	}
-	testRequest := buildTestRequest(c)
+	model_ := c.Query("model")
+	if model_ == "" {
+		model_ = strings.Split(channel.Models, ",")[0]
+	}
 	tik := time.Now()
-	err = testChannel(channel, testRequest)
+	_, err = testChannelModel(channel, model_)
 	tok := time.Now()
 	milliseconds := tok.Sub(tik).Milliseconds()
 	go channel.UpdateResponseTime(milliseconds)
@@ -119,21 +197,108 @@ func TestChannel(c *gin.Context) {
 var testAllChannelsLock sync.Mutex
 var testAllChannelsRunning bool = false
 
-// disable & notify
+// auto disable & notify, channels disabled this way will be enabled again by the circuit breaker
 func disableChannel(channelId int, channelName string, reason string) {
 	if common.RootUserEmail == "" {
 		common.RootUserEmail = model.GetRootUserEmail()
 	}
-	model.UpdateChannelStatusById(channelId, common.ChannelStatusDisabled)
-	subject := fmt.Sprintf("通道「%s」（#%d）已被禁用", channelName, channelId)
-	content := fmt.Sprintf("通道「%s」（#%d）已被禁用，原因：%s", channelName, channelId, reason)
-	err := common.SendEmail(subject, common.RootUserEmail, content)
-	if err != nil {
-		common.SysError(fmt.Sprintf("发送邮件失败：%s", err.Error()))
+	model.UpdateChannelStatusById(channelId, common.ChannelStatusAutoDisabled)
+	subject := fmt.Sprintf("通道「%s」（#%d）已被自动禁用", channelName, channelId)
+	content := fmt.Sprintf("通道「%s」（#%d）已被自动禁用，原因：%s", channelName, channelId, reason)
+	notify.Send(notify.EventChannelDisabled, subject, content)
+	model.EmitWebhookEvent(model.WebhookEventChannelDisabled, map[string]any{
+		"channel_id":   channelId,
+		"channel_name": channelName,
+		"reason":       reason,
+	})
+}
+
+// enable & notify
+func enableChannel(channelId int, channelName string) {
+	if common.RootUserEmail == "" {
+		common.RootUserEmail = model.GetRootUserEmail()
 	}
+	model.UpdateChannelStatusById(channelId, common.ChannelStatusEnabled)
+	subject := fmt.Sprintf("通道「%s」（#%d）已恢复", channelName, channelId)
+	content := fmt.Sprintf("通道「%s」（#%d）已恢复，已被重新启用", channelName, channelId)
+	notify.Send(notify.EventChannelEnabled, subject, content)
+	model.EmitWebhookEvent(model.WebhookEventChannelEnabled, map[string]any{
+		"channel_id":   channelId,
+		"channel_name": channelName,
+	})
 }
 
-func testAllChannels(c *gin.Context) error {
+// testChannelModels tests every model served by the channel, or only model_ if it is not empty
+func testChannelModels(channel *model.Channel, model_ string, disableThreshold int64) {
+	models := strings.Split(channel.Models, ",")
+	if model_ != "" {
+		models = []string{model_}
+	}
+	results := make(map[string]*ChannelTestResult)
+	var failure error
+	var maxMilliseconds int64
+	for _, m := range models {
+		m = strings.TrimSpace(m)
+		if m == "" {
+			continue
+		}
+		tik := time.Now()
+		skipped, err := testChannelModel(channel, m)
+		milliseconds := time.Since(tik).Milliseconds()
+		if skipped {
+			continue
+		}
+		if err == nil && milliseconds > disableThreshold {
+			err = errors.New(fmt.Sprintf("响应时间 %.2fs 超过阈值 %.2fs", float64(milliseconds)/1000.0, float64(disableThreshold)/1000.0))
+		}
+		result := &ChannelTestResult{
+			Model:        m,
+			Success:      err == nil,
+			ResponseTime: milliseconds,
+			TestTime:     common.GetTimestamp(),
+		}
+		if err != nil {
+			result.Message = err.Error()
+			if failure == nil {
+				failure = fmt.Errorf("模型 %s：%s", m, err.Error())
+			}
+		}
+		results[m] = result
+		model.RecordChannelHealth(channel.Id, m, model.ChannelHealthSourceTest, result.Success, milliseconds, 0, result.Message)
+		if milliseconds > maxMilliseconds {
+			maxMilliseconds = milliseconds
+		}
+	}
+	if len(results) == 0 {
+		return
+	}
+	channelTestResultsLock.Lock()
+	channelTestResults[channel.Id] = results
+	channelTestResultsLock.Unlock()
+	channel.UpdateResponseTime(maxMilliseconds)
+	if failure != nil {
+		if channel.Status == common.ChannelStatusEnabled {
+			recordChannelFailure(channel.Id, channel.Name, failure.Error())
+		}
+		return
+	}
+	if channel.Status == common.ChannelStatusAutoDisabled {
+		// recovered
+		resetChannelBreaker(channel.Id)
+		enableChannel(channel.Id, channel.Name)
+	} else {
+		recordChannelSuccess(channel.Id)
+	}
+}
+
+func finishTestingAllChannels() {
+	testAllChannelsLock.Lock()
+	testAllChannelsRunning = false
+	testAllChannelsLock.Unlock()
+}
+
+// testAllChannels tests the enabled & auto disabled channels with at most ChannelTestConcurrency channels at the same time
+func testAllChannels(model_ string, notifyFinished bool) error {
 	if common.RootUserEmail == "" {
 		common.RootUserEmail = model.GetRootUserEmail()
 	}
@@ -146,47 +311,45 @@ func testAllChannels(c *gin.Context) error {
 	testAllChannelsLock.Unlock()
 	channels, err := model.GetAllChannels(0, 0, true)
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"success": false,
-			"message": err.Error(),
-		})
+		finishTestingAllChannels()
 		return err
 	}
-	testRequest := buildTestRequest(c)
 	var disableThreshold = int64(common.ChannelDisableThreshold * 1000)
 	if disableThreshold == 0 {
 		disableThreshold = 10000000 // a impossible value
 	}
+	concurrency := common.ChannelTestConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
 	go func() {
+		defer finishTestingAllChannels()
+		var wg sync.WaitGroup
+		semaphore := make(chan struct{}, concurrency)
 		for _, channel := range channels {
-			if channel.Status != common.ChannelStatusEnabled {
+			if channel.Status != common.ChannelStatusEnabled && channel.Status != common.ChannelStatusAutoDisabled {
 				continue
 			}
-			tik := time.Now()
-			err := testChannel(channel, testRequest)
-			tok := time.Now()
-			milliseconds := tok.Sub(tik).Milliseconds()
-			if err != nil || milliseconds > disableThreshold {
-				if milliseconds > disableThreshold {
-					err = errors.New(fmt.Sprintf("响应时间 %.2fs 超过阈值 %.2fs", float64(milliseconds)/1000.0, float64(disableThreshold)/1000.0))
-				}
-				disableChannel(channel.Id, channel.Name, err.Error())
-			}
-			channel.UpdateResponseTime(milliseconds)
+			wg.Add(1)
+			semaphore <- struct{}{}
+			go func(channel *model.Channel) {
+				defer func() {
+					<-semaphore
+					wg.Done()
+				}()
+				testChannelModels(channel, model_, disableThreshold)
+			}(channel)
 		}
-		err := common.SendEmail("通道测试完成", common.RootUserEmail, "通道测试完成，如果没有收到禁用通知，说明所有通道都正常")
-		if err != nil {
-			common.SysError(fmt.Sprintf("发送邮件失败：%s", err.Error()))
+		wg.Wait()
+		if notifyFinished {
+			notify.Send(notify.EventChannelTestFinished, "通道测试完成", "通道测试完成，如果没有收到自动禁用通知，说明所有通道都正常")
 		}
-		testAllChannelsLock.Lock()
-		testAllChannelsRunning = false
-		testAllChannelsLock.Unlock()
 	}()
 	return nil
 }
 
 func TestAllChannels(c *gin.Context) {
-	err := testAllChannels(c)
+	err := testAllChannels(c.Query("model"), true)
 	if err != nil {
 		c.JSON(http.StatusOK, gin.H{
 			"success": false,
@@ -200,3 +363,34 @@ func TestAllChannels(c *gin.Context) {
 	})
 	return
 }
+
+func GetChannelTestResults(c *gin.Context) {
+	channelTestResultsLock.RLock()
+	defer channelTestResultsLock.RUnlock()
+	id, _ := strconv.Atoi(c.Query("id"))
+	if id != 0 {
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"message": "",
+			"data":    channelTestResults[id],
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    channelTestResults,
+	})
+	return
+}
+
+func AutomaticallyTestChannels(frequency int) {
+	for {
+		time.Sleep(time.Duration(frequency) * time.Second)
+		common.SysLog("testing all channels")
+		err := testAllChannels("", false)
+		if err != nil {
+			common.SysLog("failed to test all channels: " + err.Error())
+		}
+	}
+}
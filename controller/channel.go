@@ -6,7 +6,6 @@ import (
 	"one-api/common"
 	"one-api/model"
 	"strconv"
-	"strings"
 )
 
 func GetAllChannels(c *gin.Context) {
@@ -22,6 +21,9 @@ func GetAllChannels(c *gin.Context) {
 		})
 		return
 	}
+	for _, channel := range channels {
+		channel.Utilization = channel.GetUtilization(c.Request.Context())
+	}
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"message": "",
@@ -40,6 +42,9 @@ func SearchChannels(c *gin.Context) {
 		})
 		return
 	}
+	for _, channel := range channels {
+		channel.Utilization = channel.GetUtilization(c.Request.Context())
+	}
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"message": "",
@@ -65,6 +70,15 @@ func GetChannel(c *gin.Context) {
 		})
 		return
 	}
+	channel.Utilization = channel.GetUtilization(c.Request.Context())
+	channel.Keys, err = model.GetChannelKeys(channel.Id, false)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"message": "",
@@ -84,17 +98,20 @@ func AddChannel(c *gin.Context) {
 		return
 	}
 	channel.CreatedTime = common.GetTimestamp()
-	keys := strings.Split(channel.Key, "\n")
-	channels := make([]model.Channel, 0)
-	for _, key := range keys {
-		if key == "" {
-			continue
-		}
-		localChannel := channel
-		localChannel.Key = key
-		channels = append(channels, localChannel)
+	keys := model.SplitChannelKeys(channel.Key)
+	if len(keys) == 0 {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": "渠道至少需要一个密钥",
+		})
+		return
+	}
+	// one channel holds all the keys as a key pool
+	channel.Key = keys[0]
+	err = channel.Insert()
+	if err == nil {
+		err = channel.ReplaceKeys(keys)
 	}
-	err = model.BatchInsertChannels(channels)
 	if err != nil {
 		c.JSON(http.StatusOK, gin.H{
 			"success": false,
@@ -102,6 +119,7 @@ func AddChannel(c *gin.Context) {
 		})
 		return
 	}
+	recordAudit(c, "channel.create", "channel", strconv.Itoa(channel.Id), nil, &channel)
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"message": "",
@@ -111,6 +129,7 @@ func AddChannel(c *gin.Context) {
 
 func DeleteChannel(c *gin.Context) {
 	id, _ := strconv.Atoi(c.Param("id"))
+	originChannel, _ := model.GetChannelById(id, true)
 	channel := model.Channel{Id: id}
 	err := channel.Delete()
 	if err != nil {
@@ -120,6 +139,7 @@ func DeleteChannel(c *gin.Context) {
 		})
 		return
 	}
+	recordAudit(c, "channel.delete", "channel", strconv.Itoa(id), originChannel, nil)
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"message": "",
@@ -137,7 +157,13 @@ func UpdateChannel(c *gin.Context) {
 		})
 		return
 	}
+	originChannel, _ := model.GetChannelById(channel.Id, true)
+	keys := model.SplitChannelKeys(channel.Key)
+	channel.Key = ""
 	err = channel.Update()
+	if err == nil && len(keys) > 0 {
+		err = channel.ReplaceKeys(keys)
+	}
 	if err != nil {
 		c.JSON(http.StatusOK, gin.H{
 			"success": false,
@@ -145,6 +171,12 @@ func UpdateChannel(c *gin.Context) {
 		})
 		return
 	}
+	if updatedChannel, err := model.GetChannelById(channel.Id, true); err == nil {
+		recordAudit(c, "channel.update", "channel", strconv.Itoa(channel.Id), originChannel, updatedChannel)
+	}
+	if channel.Status == common.ChannelStatusEnabled || channel.Status == common.ChannelStatusDisabled {
+		resetChannelBreaker(channel.Id)
+	}
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"message": "",
@@ -152,3 +184,40 @@ func UpdateChannel(c *gin.Context) {
 	})
 	return
 }
+
+type channelKeyStatusRequest struct {
+	Id     int `json:"id"`
+	Status int `json:"status"`
+}
+
+func UpdateChannelKeyStatus(c *gin.Context) {
+	var req channelKeyStatusRequest
+	err := c.ShouldBindJSON(&req)
+	if err != nil || (req.Status != common.ChannelKeyStatusEnabled && req.Status != common.ChannelKeyStatusDisabled) {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": "无效的参数",
+		})
+		return
+	}
+	err = model.UpdateChannelKeyStatus(req.Id, req.Status, "")
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	recordAudit(c, "channel_key.update_status", "channel_key", strconv.Itoa(req.Id), nil, map[string]any{"status": req.Status})
+	if req.Status == common.ChannelKeyStatusEnabled {
+		channelId, err := model.GetChannelIdByKeyId(req.Id)
+		if err == nil {
+			resumeChannelProbe(channelId)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+	})
+	return
+}
@@ -0,0 +1,220 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"one-api/common"
+	"one-api/model"
+	"strconv"
+	"time"
+)
+
+var consumeLogExportColumns = []string{"id", "time", "user_id", "token_id", "model_name", "channel_id", "prompt_tokens", "completion_tokens", "quota", "amount"}
+var usageStatExportColumns = []string{"period_start", "user_id", "token_id", "model_name", "requests", "prompt_tokens", "completion_tokens", "quota", "amount"}
+
+// exportWriter streams the rows as CSV or JSONL, the rows are flushed to the client batch by batch
+type exportWriter struct {
+	c       *gin.Context
+	columns []string
+	csv     *csv.Writer
+}
+
+// newExportWriter writes the headers of the response, nothing can be returned as JSON after it is called
+func newExportWriter(c *gin.Context, format string, name string, columns []string) *exportWriter {
+	writer := &exportWriter{c: c, columns: columns}
+	filename := name + "-" + time.Now().Format("20060102150405") + "." + format
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	if format == "csv" {
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		writer.csv = csv.NewWriter(c.Writer)
+		_ = writer.csv.Write(columns)
+	} else {
+		c.Header("Content-Type", "application/x-ndjson")
+	}
+	c.Status(http.StatusOK)
+	return writer
+}
+
+func (writer *exportWriter) write(values ...any) error {
+	if writer.csv != nil {
+		record := make([]string, len(values))
+		for i, value := range values {
+			record[i] = fmt.Sprint(value)
+		}
+		return writer.csv.Write(record)
+	}
+	// the fields are written in the order of the columns
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, value := range values {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(writer.columns[i])
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(data)
+	}
+	buf.WriteString("}\n")
+	_, err := writer.c.Writer.Write(buf.Bytes())
+	return err
+}
+
+func (writer *exportWriter) flush() error {
+	if writer.csv != nil {
+		writer.csv.Flush()
+		if err := writer.csv.Error(); err != nil {
+			return err
+		}
+	}
+	writer.c.Writer.Flush()
+	return nil
+}
+
+// quotaToAmount converts the quota to currency with QuotaPerUnit
+func quotaToAmount(quota int64) json.Number {
+	return json.Number(strconv.FormatFloat(float64(quota)/common.QuotaPerUnit, 'f', 6, 64))
+}
+
+// parseExportFilter reads the format (csv or jsonl), the granularity of the stats (day or hour) & the range,
+// the last 30 days are exported if the range is not set
+func parseExportFilter(c *gin.Context) (*model.ExportFilter, string, string) {
+	format := c.DefaultQuery("format", "csv")
+	if format != "csv" && format != "jsonl" {
+		return nil, "", "无效的导出格式"
+	}
+	filter := &model.ExportFilter{}
+	switch c.DefaultQuery("granularity", "day") {
+	case "day":
+		filter.Granularity = model.UsageStatGranularityDay
+	case "hour":
+		filter.Granularity = model.UsageStatGranularityHour
+	default:
+		return nil, "", "无效的统计粒度"
+	}
+	filter.EndTimestamp, _ = strconv.ParseInt(c.Query("end_timestamp"), 10, 64)
+	if filter.EndTimestamp == 0 {
+		filter.EndTimestamp = common.GetTimestamp()
+	}
+	filter.StartTimestamp, _ = strconv.ParseInt(c.Query("start_timestamp"), 10, 64)
+	if filter.StartTimestamp == 0 {
+		filter.StartTimestamp = filter.EndTimestamp - 30*24*60*60
+	}
+	filter.TokenId, _ = strconv.Atoi(c.Query("token_id"))
+	return filter, format, ""
+}
+
+func exportConsumeLogs(c *gin.Context, filter *model.ExportFilter, format string) {
+	writer := newExportWriter(c, format, "logs", consumeLogExportColumns)
+	err := model.ExportConsumeLogs(filter, func(logs []*model.Log) error {
+		for _, log := range logs {
+			err := writer.write(log.Id, time.Unix(log.CreatedAt, 0).UTC().Format(time.RFC3339), log.UserId, log.TokenId,
+				log.ModelName, log.ChannelId, log.PromptTokens, log.CompletionTokens, log.Quota, quotaToAmount(int64(log.Quota)))
+			if err != nil {
+				return err
+			}
+		}
+		return writer.flush()
+	})
+	if err == nil {
+		err = writer.flush()
+	}
+	if err != nil {
+		// the response has been started, the export is cut short
+		common.LogError(c, "failed to export consume logs", "error", err.Error())
+	}
+}
+
+func exportUsageStats(c *gin.Context, filter *model.ExportFilter, format string) {
+	writer := newExportWriter(c, format, "stats", usageStatExportColumns)
+	err := model.ExportUsageStats(filter, func(stats []*model.UsageStatExport) error {
+		for _, stat := range stats {
+			err := writer.write(time.Unix(stat.PeriodStart, 0).UTC().Format(time.RFC3339), stat.UserId, stat.TokenId, stat.ModelName,
+				stat.Requests, stat.PromptTokens, stat.CompletionTokens, stat.Quota, quotaToAmount(stat.Quota))
+			if err != nil {
+				return err
+			}
+		}
+		return writer.flush()
+	})
+	if err == nil {
+		err = writer.flush()
+	}
+	if err != nil {
+		common.LogError(c, "failed to export usage stats", "error", err.Error())
+	}
+}
+
+func ExportConsumeLogs(c *gin.Context) {
+	filter, format, message := parseExportFilter(c)
+	if message != "" {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": message,
+		})
+		return
+	}
+	filter.UserId, _ = strconv.Atoi(c.Query("user_id"))
+	recordAudit(c, "export.logs", "user", strconv.Itoa(filter.UserId), nil, gin.H{
+		"token_id":        filter.TokenId,
+		"start_timestamp": filter.StartTimestamp,
+		"end_timestamp":   filter.EndTimestamp,
+	})
+	exportConsumeLogs(c, filter, format)
+	return
+}
+
+func ExportSelfConsumeLogs(c *gin.Context) {
+	filter, format, message := parseExportFilter(c)
+	if message != "" {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": message,
+		})
+		return
+	}
+	filter.UserId = c.GetInt("id")
+	exportConsumeLogs(c, filter, format)
+	return
+}
+
+func ExportUsageStats(c *gin.Context) {
+	filter, format, message := parseExportFilter(c)
+	if message != "" {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": message,
+		})
+		return
+	}
+	filter.UserId, _ = strconv.Atoi(c.Query("user_id"))
+	recordAudit(c, "export.stats", "user", strconv.Itoa(filter.UserId), nil, gin.H{
+		"token_id":        filter.TokenId,
+		"start_timestamp": filter.StartTimestamp,
+		"end_timestamp":   filter.EndTimestamp,
+	})
+	exportUsageStats(c, filter, format)
+	return
+}
+
+func ExportSelfUsageStats(c *gin.Context) {
+	filter, format, message := parseExportFilter(c)
+	if message != "" {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": message,
+		})
+		return
+	}
+	filter.UserId = c.GetInt("id")
+	exportUsageStats(c, filter, format)
+	return
+}
@@ -84,3 +84,34 @@ func SearchUserLogs(c *gin.Context) {
 		"data":    logs,
 	})
 }
+
+func DeleteHistoryLogs(c *gin.Context) {
+	targetTimestamp, _ := strconv.ParseInt(c.Query("target_timestamp"), 10, 64)
+	if targetTimestamp <= 0 {
+		c.JSON(200, gin.H{
+			"success": false,
+			"message": "target timestamp is required",
+		})
+		return
+	}
+	logType, _ := strconv.Atoi(c.Query("type"))
+	count, err := model.DeleteLogsBefore(logType, targetTimestamp)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	recordAudit(c, "log.delete", "log", strconv.Itoa(logType), nil, gin.H{
+		"target_timestamp": targetTimestamp,
+		"type":             logType,
+		"count":            count,
+	})
+	c.JSON(200, gin.H{
+		"success": true,
+		"message": "",
+		"data":    count,
+	})
+	return
+}
@@ -3,6 +3,7 @@ package controller
 import (
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"one-api/common"
 )
 
 // https://platform.openai.com/docs/api-reference/models/list
@@ -169,19 +170,29 @@ func init() {
 }
 
 func ListModels(c *gin.Context) {
+	models := openAIModels
+	tokenModels := c.GetString("token_models")
+	if tokenModels != "" {
+		models = make([]OpenAIModels, 0, len(openAIModels))
+		for _, model := range openAIModels {
+			if common.IsModelAllowed(tokenModels, model.Id) {
+				models = append(models, model)
+			}
+		}
+	}
 	c.JSON(200, gin.H{
 		"object": "list",
-		"data":   openAIModels,
+		"data":   models,
 	})
 }
 
 func RetrieveModel(c *gin.Context) {
 	modelId := c.Param("model")
-	if model, ok := openAIModelsMap[modelId]; ok {
+	if model, ok := openAIModelsMap[modelId]; ok && common.IsModelAllowed(c.GetString("token_models"), modelId) {
 		c.JSON(200, model)
 	} else {
 		openAIError := OpenAIError{
-			Message: fmt.Sprintf("The model '%s' does not exist", modelId),
+			Message: common.MessageWithRequestId(c, fmt.Sprintf("The model '%s' does not exist", modelId)),
 			Type:    "invalid_request_error",
 			Param:   "model",
 			Code:    "model_not_found",
@@ -5,7 +5,9 @@ import (
 	"github.com/gin-gonic/gin"
 	"net/http"
 	"one-api/common"
+	"one-api/common/notify"
 	"one-api/model"
+	"strconv"
 	"strings"
 )
 
@@ -16,6 +18,9 @@ func GetOptions(c *gin.Context) {
 		if strings.Contains(k, "Token") || strings.Contains(k, "Secret") {
 			continue
 		}
+		if k == "NotificationSinks" {
+			v = notify.RedactSinksJSONString(v)
+		}
 		options = append(options, &model.Option{
 			Key:   k,
 			Value: common.Interface2String(v),
@@ -41,6 +46,16 @@ func UpdateOption(c *gin.Context) {
 		return
 	}
 	switch option.Key {
+	case "NotificationSinks":
+		// the sinks are shown redacted, keep the urls & secrets which were not changed
+		option.Value, err = notify.RestoreRedactedSinks(option.Value)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"success": false,
+				"message": err.Error(),
+			})
+			return
+		}
 	case "GitHubOAuthEnabled":
 		if option.Value == "true" && common.GitHubClientId == "" {
 			c.JSON(http.StatusOK, gin.H{
@@ -65,7 +80,26 @@ func UpdateOption(c *gin.Context) {
 			})
 			return
 		}
+	case "QuotaPerUnit":
+		if quotaPerUnit, _ := strconv.ParseFloat(option.Value, 64); quotaPerUnit <= 0 {
+			c.JSON(http.StatusOK, gin.H{
+				"success": false,
+				"message": "QuotaPerUnit must be a positive number",
+			})
+			return
+		}
+	case "ContentLogMaxSize":
+		if maxSize, _ := strconv.Atoi(option.Value); maxSize <= 0 {
+			c.JSON(http.StatusOK, gin.H{
+				"success": false,
+				"message": "ContentLogMaxSize must be a positive integer",
+			})
+			return
+		}
 	}
+	common.OptionMapRWMutex.RLock()
+	before, exists := common.OptionMap[option.Key]
+	common.OptionMapRWMutex.RUnlock()
 	err = model.UpdateOption(option.Key, option.Value)
 	if err != nil {
 		c.JSON(http.StatusOK, gin.H{
@@ -74,9 +108,25 @@ func UpdateOption(c *gin.Context) {
 		})
 		return
 	}
+	recordOptionAudit(c, option.Key, before, exists, option.Value)
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"message": "",
 	})
 	return
 }
+
+func recordOptionAudit(c *gin.Context, key string, before string, exists bool, after string) {
+	field := "value"
+	if key == "NotificationSinks" {
+		before = notify.RedactSinksJSONString(before)
+		after = notify.RedactSinksJSONString(after)
+	} else if model.IsSecretOption(key) {
+		field = "secret"
+	}
+	var beforeFields map[string]any
+	if exists {
+		beforeFields = map[string]any{field: before}
+	}
+	recordAudit(c, "option.update", "option", key, beforeFields, map[string]any{field: after})
+}
@@ -1,10 +1,21 @@
 package controller
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"github.com/gin-gonic/gin"
 	"github.com/pkoukk/tiktoken-go"
+	"io"
+	"math/rand"
+	"net/http"
 	"one-api/common"
+	"one-api/common/limiter"
+	"one-api/common/metrics"
+	"one-api/model"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var tokenEncoderMap = map[string]*tiktoken.Tiktoken{}
@@ -63,3 +74,79 @@ func countTokenText(text string, model string) int {
 	token := tokenEncoder.Encode(text, nil, nil)
 	return len(token)
 }
+
+// recordRateLimitTokens adds the used tokens to the TPM limits set by middleware.RelayRateLimit
+func recordRateLimitTokens(c *gin.Context, tokens int) {
+	tpmLimits, ok := c.Get("tpm_rate_limits")
+	if !ok {
+		return
+	}
+	for key, limit := range tpmLimits.(map[string]int) {
+		_, err := limiter.Default().Add(context.Background(), key, limit, time.Minute, tokens)
+		if err != nil {
+			common.LogError(c, "failed to record tpm usage", "key", key, "tokens", tokens, "error", err.Error())
+		}
+	}
+}
+
+// recordRelayLatency records the relay request to the channel health history with the probability of RelayLatencySampleRate
+func recordRelayLatency(c *gin.Context, err *OpenAIErrorWithStatusCode, milliseconds int64) {
+	if common.RelayLatencySampleRate <= 0 || rand.Float64() >= common.RelayLatencySampleRate {
+		return
+	}
+	channelId := c.GetInt("channel_id")
+	model_ := c.GetString("relay_model")
+	firstTokenTime := c.GetInt64("first_token_time")
+	message := ""
+	if err != nil {
+		message = err.Message
+	}
+	go model.RecordChannelHealth(channelId, model_, model.ChannelHealthSourceRelay, err == nil, milliseconds, firstTokenTime, message)
+}
+
+func recordRelayMetrics(c *gin.Context, err *OpenAIErrorWithStatusCode, duration time.Duration) {
+	channel := strconv.Itoa(c.GetInt("channel_id"))
+	model_ := c.GetString("relay_model")
+	status := c.Writer.Status()
+	if err != nil {
+		status = err.StatusCode
+		// errors of one api itself are not counted, except failing to reach the upstream
+		if err.Type != "one_api_error" || err.Code == "do_request_failed" {
+			code := err.Code
+			if code == "" {
+				code = err.Type
+			}
+			metrics.UpstreamErrors.WithLabelValues(channel, code).Inc()
+		}
+	}
+	if status == 0 {
+		status = http.StatusOK
+	}
+	metrics.RelayRequests.WithLabelValues(model_, channel, strconv.Itoa(status)).Inc()
+	metrics.RelayDuration.WithLabelValues(model_, channel).Observe(duration.Seconds())
+	if firstTokenTime, ok := c.Get("first_token_time"); ok {
+		metrics.RelayFirstToken.WithLabelValues(model_, channel).Observe(float64(firstTokenTime.(int64)) / 1000)
+	}
+}
+
+// shouldLogContent returns true if root enabled content logging for the token or its group
+func shouldLogContent(c *gin.Context) bool {
+	if !c.GetBool("token_content_logging") && common.ContentLogGroups == "" {
+		return false
+	}
+	group := c.GetString("token_group")
+	if group == "" {
+		group, _ = model.GetUserGroup(c.GetInt("id"))
+	}
+	return model.ShouldLogContent(c.GetBool("token_content_logging"), group)
+}
+
+// readRequestContent returns the request body and keeps it readable for the upstream request
+func readRequestContent(c *gin.Context) string {
+	requestBody, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		common.LogError(c, "failed to read request body", "error", err.Error())
+	}
+	c.Request.Body = io.NopCloser(bytes.NewBuffer(requestBody))
+	return string(requestBody)
+}
@@ -6,11 +6,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
 	"io"
 	"net/http"
 	"one-api/common"
+	"one-api/common/metrics"
+	"one-api/common/tracing"
 	"one-api/model"
 	"strings"
+	"time"
 )
 
 type Message struct {
@@ -101,21 +108,51 @@ func Relay(c *gin.Context) {
 	} else if strings.HasPrefix(c.Request.URL.Path, "/v1/embeddings") {
 		relayMode = RelayModeEmbeddings
 	}
+	tik := time.Now()
+	c.Set("relay_start_time", tik)
 	err := relayHelper(c, relayMode)
+	recordRelayLatency(c, err, time.Since(tik).Milliseconds())
+	recordRelayMetrics(c, err, time.Since(tik))
 	if err != nil {
 		if err.StatusCode == http.StatusTooManyRequests {
 			err.OpenAIError.Message = "负载已满，请稍后再试，或升级账户以提升服务质量。"
 		}
+		openAIError := err.OpenAIError
+		openAIError.Message = common.MessageWithRequestId(c, openAIError.Message)
 		c.JSON(err.StatusCode, gin.H{
-			"error": err.OpenAIError,
+			"error": openAIError,
 		})
 		channelId := c.GetInt("channel_id")
-		common.SysError(fmt.Sprintf("Relay error (channel #%d): %s", channelId, err.Message))
-		// https://platform.openai.com/docs/guides/error-codes/api-errors
-		if common.AutomaticDisableChannelEnabled && (err.Type == "insufficient_quota" || err.Code == "invalid_api_key") {
-			channelId := c.GetInt("channel_id")
+		common.LogError(c, "relay error",
+			"user_id", c.GetInt("id"),
+			"token_id", c.GetInt("token_id"),
+			"channel_id", channelId,
+			"model", c.GetString("relay_model"),
+			"status", err.StatusCode,
+			"code", err.Code,
+			"error", err.Message,
+		)
+		if shouldDisableChannelKey(err) && disableChannelKey(channelId, c.GetInt("channel_key_id"), err.Message) {
+			// other keys of the channel are still available
+			return
+		}
+		if shouldCountChannelFailure(err) {
 			channelName := c.GetString("channel_name")
-			disableChannel(channelId, channelName, err.Message)
+			recordChannelFailure(channelId, channelName, err.Message)
+			model.RecordChannelLatencyFailure(channelId, c.GetBool("relay_stream"))
+		}
+	} else {
+		channelId := c.GetInt("channel_id")
+		recordChannelSuccess(channelId)
+		// the total time grows with the length of the completion, the time to the first token of a stream
+		// or to the headers of the response is the latency of the channel, they are kept apart
+		stream := c.GetBool("relay_stream")
+		latency := c.GetInt64("upstream_header_time")
+		if stream {
+			latency = c.GetInt64("first_token_time")
+		}
+		if latency > 0 {
+			model.UpdateChannelLatency(channelId, stream, latency)
 		}
 	}
 }
@@ -143,6 +180,13 @@ func relayHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode {
 			return errorWrapper(err, "bind_request_body_failed", http.StatusBadRequest)
 		}
 	}
+	c.Set("relay_model", textRequest.Model)
+	c.Set("relay_stream", textRequest.Stream)
+	var requestContent, responseContent string
+	logContent := shouldLogContent(c)
+	if logContent {
+		requestContent = readRequestContent(c)
+	}
 	baseURL := common.ChannelBaseURLs[channelType]
 	requestURL := c.Request.URL.String()
 	if channelType == common.ChannelTypeCustom {
@@ -171,12 +215,15 @@ func relayHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode {
 		return err
 	}
 	var promptTokens int
+	_, countSpan := tracing.StartSpan(c, "CountPromptTokens")
 	switch relayMode {
 	case RelayModeChatCompletions:
 		promptTokens = countTokenMessages(textRequest.Messages, textRequest.Model)
 	case RelayModeCompletions:
 		promptTokens = countTokenText(textRequest.Prompt, textRequest.Model)
 	}
+	countSpan.SetAttributes(attribute.Int("one_api.prompt_tokens", promptTokens))
+	countSpan.End()
 	preConsumedTokens := common.PreConsumedQuota
 	if textRequest.MaxTokens != 0 {
 		preConsumedTokens = promptTokens + textRequest.MaxTokens
@@ -184,15 +231,31 @@ func relayHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode {
 	ratio := common.GetModelRatio(textRequest.Model)
 	preConsumedQuota := int(float64(preConsumedTokens) * ratio)
 	if consumeQuota {
+		_, preConsumeSpan := tracing.StartSpan(c, "PreConsumeQuota", attribute.Int("one_api.quota", preConsumedQuota))
 		err := model.PreConsumeTokenQuota(tokenId, preConsumedQuota)
 		if err != nil {
+			tracing.RecordError(preConsumeSpan, err)
+			preConsumeSpan.End()
 			return errorWrapper(err, "pre_consume_token_quota_failed", http.StatusOK)
 		}
+		preConsumeSpan.End()
 	}
+	// the upstream span lasts until the response is relayed, including the stream
+	upstreamCtx, upstreamSpan := tracing.Tracer.Start(c.Request.Context(), "Upstream",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPMethod(c.Request.Method),
+			attribute.String("one_api.model", textRequest.Model),
+			attribute.Int("one_api.channel_id", c.GetInt("channel_id")),
+			attribute.Int("one_api.channel_type", channelType),
+		))
+	defer upstreamSpan.End()
 	req, err := http.NewRequest(c.Request.Method, fullRequestURL, c.Request.Body)
 	if err != nil {
+		tracing.RecordError(upstreamSpan, err)
 		return errorWrapper(err, "new_request_failed", http.StatusOK)
 	}
+	tracing.Inject(upstreamCtx, req.Header)
 	if channelType == common.ChannelTypeAzure {
 		key := c.Request.Header.Get("Authorization")
 		key = strings.TrimPrefix(key, "Bearer ")
@@ -206,8 +269,14 @@ func relayHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode {
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
+		tracing.RecordError(upstreamSpan, err)
 		return errorWrapper(err, "do_request_failed", http.StatusOK)
 	}
+	c.Set("upstream_header_time", time.Since(c.GetTime("relay_start_time")).Milliseconds())
+	upstreamSpan.SetAttributes(semconv.HTTPStatusCode(resp.StatusCode))
+	if resp.StatusCode >= http.StatusBadRequest {
+		upstreamSpan.SetStatus(codes.Error, resp.Status)
+	}
 	err = req.Body.Close()
 	if err != nil {
 		return errorWrapper(err, "close_request_body_failed", http.StatusOK)
@@ -221,25 +290,66 @@ func relayHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode {
 	var streamResponseText string
 
 	defer func() {
+		upstreamSpan.End()
+		if logContent {
+			if isStream {
+				responseContent = streamResponseText
+			}
+			go model.RecordContentLog(&model.ContentLog{
+				RequestId: c.GetString(common.RequestIdKey),
+				UserId:    c.GetInt("id"),
+				TokenId:   tokenId,
+				ChannelId: c.GetInt("channel_id"),
+				ModelName: textRequest.Model,
+				Request:   requestContent,
+				Response:  responseContent,
+			})
+		}
 		if consumeQuota {
+			_, postConsumeSpan := tracing.StartSpan(c, "PostConsumeQuota")
+			defer postConsumeSpan.End()
 			quota := 0
 			usingGPT4 := strings.HasPrefix(textRequest.Model, "gpt-4")
 			completionRatio := 1
 			if usingGPT4 {
 				completionRatio = 2
 			}
+			usedPromptTokens := promptTokens
+			completionTokens := 0
 			if isStream {
-				responseTokens := countTokenText(streamResponseText, textRequest.Model)
-				quota = promptTokens + responseTokens*completionRatio
+				completionTokens = countTokenText(streamResponseText, textRequest.Model)
 			} else {
-				quota = textResponse.Usage.PromptTokens + textResponse.Usage.CompletionTokens*completionRatio
+				usedPromptTokens = textResponse.Usage.PromptTokens
+				completionTokens = textResponse.Usage.CompletionTokens
 			}
+			quota = usedPromptTokens + completionTokens*completionRatio
+			recordRateLimitTokens(c, usedPromptTokens+completionTokens)
 			quota = int(float64(quota) * ratio)
 			quotaDelta := quota - preConsumedQuota
+			metrics.RelayTokens.WithLabelValues(textRequest.Model, "prompt").Add(float64(usedPromptTokens))
+			metrics.RelayTokens.WithLabelValues(textRequest.Model, "completion").Add(float64(completionTokens))
+			metrics.QuotaConsumed.WithLabelValues(textRequest.Model).Add(float64(quota))
+			postConsumeSpan.SetAttributes(attribute.Int("one_api.quota", quota))
 			err := model.PostConsumeTokenQuota(tokenId, quotaDelta)
 			if err != nil {
-				common.SysError("Error consuming token remain quota: " + err.Error())
+				tracing.RecordError(postConsumeSpan, err)
+				common.LogError(c, "failed to post consume quota",
+					"user_id", c.GetInt("id"),
+					"token_id", tokenId,
+					"quota_delta", quotaDelta,
+					"error", err.Error(),
+				)
 			}
+			model.RecordConsumeLog(&model.Log{
+				UserId:           c.GetInt("id"),
+				TokenId:          tokenId,
+				ModelName:        textRequest.Model,
+				ChannelId:        c.GetInt("channel_id"),
+				PromptTokens:     usedPromptTokens,
+				CompletionTokens: completionTokens,
+				Quota:            quota,
+				RoutingStrategy:  c.GetString("routing_strategy"),
+			})
 		}
 	}()
 
@@ -266,7 +376,7 @@ func relayHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode {
 			for scanner.Scan() {
 				data := scanner.Text()
 				if len(data) < 6 { // must be something wrong!
-					common.SysError("Invalid stream response: " + data)
+					common.LogError(c, "invalid stream response", "channel_id", c.GetInt("channel_id"), "data", data)
 					continue
 				}
 				dataChan <- data
@@ -277,7 +387,7 @@ func relayHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode {
 						var streamResponse ChatCompletionsStreamResponse
 						err = json.Unmarshal([]byte(data), &streamResponse)
 						if err != nil {
-							common.SysError("Error unmarshalling stream response: " + err.Error())
+							common.LogError(c, "failed to unmarshal stream response", "channel_id", c.GetInt("channel_id"), "error", err.Error())
 							return
 						}
 						for _, choice := range streamResponse.Choices {
@@ -287,7 +397,7 @@ func relayHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode {
 						var streamResponse CompletionsStreamResponse
 						err = json.Unmarshal([]byte(data), &streamResponse)
 						if err != nil {
-							common.SysError("Error unmarshalling stream response: " + err.Error())
+							common.LogError(c, "failed to unmarshal stream response", "channel_id", c.GetInt("channel_id"), "error", err.Error())
 							return
 						}
 						for _, choice := range streamResponse.Choices {
@@ -303,9 +413,14 @@ func relayHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode {
 		c.Writer.Header().Set("Connection", "keep-alive")
 		c.Writer.Header().Set("Transfer-Encoding", "chunked")
 		c.Writer.Header().Set("X-Accel-Buffering", "no")
+		firstTokenReceived := false
 		c.Stream(func(w io.Writer) bool {
 			select {
 			case data := <-dataChan:
+				if !firstTokenReceived {
+					firstTokenReceived = true
+					c.Set("first_token_time", time.Since(c.GetTime("relay_start_time")).Milliseconds())
+				}
 				if strings.HasPrefix(data, "data: [DONE]") {
 					data = data[:12]
 				}
@@ -330,6 +445,7 @@ func relayHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode {
 			if err != nil {
 				return errorWrapper(err, "close_response_body_failed", http.StatusOK)
 			}
+			responseContent = string(responseBody)
 			err = json.Unmarshal(responseBody, &textResponse)
 			if err != nil {
 				return errorWrapper(err, "unmarshal_response_body_failed", http.StatusOK)
@@ -365,7 +481,7 @@ func relayHelper(c *gin.Context, relayMode int) *OpenAIErrorWithStatusCode {
 
 func RelayNotImplemented(c *gin.Context) {
 	err := OpenAIError{
-		Message: "API not implemented",
+		Message: common.MessageWithRequestId(c, "API not implemented"),
 		Type:    "one_api_error",
 		Param:   "",
 		Code:    "api_not_implemented",
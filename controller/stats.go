@@ -0,0 +1,139 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"one-api/common"
+	"one-api/model"
+	"strconv"
+)
+
+// parseUsageStatFilter reads the granularity (hour or day) & the range, the last day is returned by hour
+// and the last 30 days by day if the range is not set
+func parseUsageStatFilter(c *gin.Context) (*model.UsageStatFilter, string) {
+	filter := &model.UsageStatFilter{}
+	defaultRange := int64(24 * 60 * 60)
+	switch c.DefaultQuery("granularity", "hour") {
+	case "hour":
+		filter.Granularity = model.UsageStatGranularityHour
+	case "day":
+		filter.Granularity = model.UsageStatGranularityDay
+		defaultRange = 30 * 24 * 60 * 60
+	default:
+		return nil, "无效的统计粒度"
+	}
+	filter.EndTimestamp, _ = strconv.ParseInt(c.Query("end_timestamp"), 10, 64)
+	if filter.EndTimestamp == 0 {
+		filter.EndTimestamp = common.GetTimestamp()
+	}
+	filter.StartTimestamp, _ = strconv.ParseInt(c.Query("start_timestamp"), 10, 64)
+	if filter.StartTimestamp == 0 {
+		filter.StartTimestamp = filter.EndTimestamp - defaultRange
+	}
+	filter.TokenId, _ = strconv.Atoi(c.Query("token_id"))
+	filter.ModelName = c.Query("model_name")
+	return filter, ""
+}
+
+func getUsageStats(c *gin.Context, filter *model.UsageStatFilter) {
+	points, err := model.GetUsageStats(filter)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    points,
+	})
+}
+
+func getTopUsageStats(c *gin.Context, filter *model.UsageStatFilter) {
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	if limit <= 0 || limit > 100 {
+		limit = 10
+	}
+	tops, err := model.GetTopUsageStats(filter, c.DefaultQuery("dimension", "model"), c.DefaultQuery("order_by", "quota"), limit)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    tops,
+	})
+}
+
+func GetUsageStats(c *gin.Context) {
+	filter, message := parseUsageStatFilter(c)
+	if message != "" {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": message,
+		})
+		return
+	}
+	filter.UserId, _ = strconv.Atoi(c.Query("user_id"))
+	filter.ChannelId, _ = strconv.Atoi(c.Query("channel_id"))
+	getUsageStats(c, filter)
+	return
+}
+
+func GetSelfUsageStats(c *gin.Context) {
+	filter, message := parseUsageStatFilter(c)
+	if message != "" {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": message,
+		})
+		return
+	}
+	filter.UserId = c.GetInt("id")
+	getUsageStats(c, filter)
+	return
+}
+
+func GetTopUsageStats(c *gin.Context) {
+	filter, message := parseUsageStatFilter(c)
+	if message != "" {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": message,
+		})
+		return
+	}
+	filter.UserId, _ = strconv.Atoi(c.Query("user_id"))
+	filter.ChannelId, _ = strconv.Atoi(c.Query("channel_id"))
+	getTopUsageStats(c, filter)
+	return
+}
+
+func GetSelfTopUsageStats(c *gin.Context) {
+	filter, message := parseUsageStatFilter(c)
+	if message != "" {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": message,
+		})
+		return
+	}
+	// the channels are not shown to the users
+	dimension := c.DefaultQuery("dimension", "model")
+	if dimension != "model" && dimension != "token" {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": "invalid dimension: " + dimension,
+		})
+		return
+	}
+	filter.UserId = c.GetInt("id")
+	getTopUsageStats(c, filter)
+	return
+}
@@ -1,11 +1,13 @@
 package controller
 
 import (
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"net/http"
 	"one-api/common"
 	"one-api/model"
 	"strconv"
+	"time"
 )
 
 func GetAllTokens(c *gin.Context) {
@@ -99,6 +101,21 @@ func GetTokenStatus(c *gin.Context) {
 	})
 }
 
+// validateTokenGroup rejects the groups served by no channel, the requests of a token in such a group could never be relayed
+func validateTokenGroup(group string) error {
+	if group == "" {
+		return nil
+	}
+	ok, err := model.IsGroupServed(group)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("The group %s is not served by any channel", group)
+	}
+	return nil
+}
+
 func AddToken(c *gin.Context) {
 	token := model.Token{}
 	err := c.ShouldBindJSON(&token)
@@ -116,6 +133,44 @@ func AddToken(c *gin.Context) {
 		})
 		return
 	}
+	err = common.ValidateModelPatterns(token.Models)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	err = common.ValidateSubnets(token.Subnet)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	if !common.IsValidQuotaPeriod(token.QuotaPeriod) {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": "Invalid quota period",
+		})
+		return
+	}
+	if token.Group != "" && c.GetInt("role") < common.RoleAdminUser {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": "Only administrators can set the group of a token",
+		})
+		return
+	}
+	err = validateTokenGroup(token.Group)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
 	cleanToken := model.Token{
 		UserId:         c.GetInt("id"),
 		Name:           token.Name,
@@ -125,6 +180,17 @@ func AddToken(c *gin.Context) {
 		ExpiredTime:    token.ExpiredTime,
 		RemainQuota:    token.RemainQuota,
 		UnlimitedQuota: token.UnlimitedQuota,
+		Models:         token.Models,
+		Group:          token.Group,
+		Subnet:         token.Subnet,
+		RateLimitRPM:   token.RateLimitRPM,
+		RateLimitTPM:   token.RateLimitTPM,
+		QuotaPeriod:    token.QuotaPeriod,
+		PeriodQuota:    token.PeriodQuota,
+	}
+	if cleanToken.QuotaPeriod != common.TokenQuotaPeriodNone {
+		cleanToken.RemainQuota = cleanToken.PeriodQuota
+		cleanToken.PeriodStart = common.GetQuotaPeriodStart(cleanToken.QuotaPeriod, time.Now())
 	}
 	err = cleanToken.Insert()
 	if err != nil {
@@ -134,9 +200,11 @@ func AddToken(c *gin.Context) {
 		})
 		return
 	}
+	// the key is only stored hashed, so this is the only chance to see it
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"message": "",
+		"data":    cleanToken,
 	})
 	return
 }
@@ -179,6 +247,39 @@ func UpdateToken(c *gin.Context) {
 		})
 		return
 	}
+	err = common.ValidateModelPatterns(token.Models)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	err = common.ValidateSubnets(token.Subnet)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	if statusOnly == "" && !common.IsValidQuotaPeriod(token.QuotaPeriod) {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": "Invalid quota period",
+		})
+		return
+	}
+	if statusOnly == "" && c.GetInt("role") >= common.RoleAdminUser && token.Group != cleanToken.Group {
+		err = validateTokenGroup(token.Group)
+		if err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"success": false,
+				"message": err.Error(),
+			})
+			return
+		}
+	}
 	if token.Status == common.TokenStatusEnabled {
 		if cleanToken.Status == common.TokenStatusExpired && cleanToken.ExpiredTime <= common.GetTimestamp() {
 			c.JSON(http.StatusOK, gin.H{
@@ -203,6 +304,22 @@ func UpdateToken(c *gin.Context) {
 		cleanToken.ExpiredTime = token.ExpiredTime
 		cleanToken.RemainQuota = token.RemainQuota
 		cleanToken.UnlimitedQuota = token.UnlimitedQuota
+		cleanToken.Models = token.Models
+		cleanToken.Subnet = token.Subnet
+		cleanToken.RateLimitRPM = token.RateLimitRPM
+		cleanToken.RateLimitTPM = token.RateLimitTPM
+		if c.GetInt("role") >= common.RoleAdminUser {
+			cleanToken.Group = token.Group
+		}
+		// a new period starts when the period settings change
+		if token.QuotaPeriod != cleanToken.QuotaPeriod || token.PeriodQuota != cleanToken.PeriodQuota {
+			cleanToken.QuotaPeriod = token.QuotaPeriod
+			cleanToken.PeriodQuota = token.PeriodQuota
+			cleanToken.PeriodStart = common.GetQuotaPeriodStart(cleanToken.QuotaPeriod, time.Now())
+			if cleanToken.QuotaPeriod != common.TokenQuotaPeriodNone {
+				cleanToken.RemainQuota = cleanToken.PeriodQuota
+			}
+		}
 	}
 	err = cleanToken.Update()
 	if err != nil {
@@ -219,3 +336,67 @@ func UpdateToken(c *gin.Context) {
 	})
 	return
 }
+
+type tokenGroupRequest struct {
+	TokenId int    `json:"token_id"`
+	Group   string `json:"group"`
+}
+
+// UpdateTokenGroup overrides the group of the token of any user, an empty group means the group of the user
+func UpdateTokenGroup(c *gin.Context) {
+	var req tokenGroupRequest
+	err := c.ShouldBindJSON(&req)
+	if err != nil || req.TokenId == 0 {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": "Invalid parameters",
+		})
+		return
+	}
+	token, err := model.GetTokenById(req.TokenId)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	owner, err := model.GetUserById(token.UserId, false)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	myRole := c.GetInt("role")
+	if owner.Id != c.GetInt("id") && myRole <= owner.Role && myRole != common.RoleRootUser {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": "No permission to update the tokens of users with the same or a higher role",
+		})
+		return
+	}
+	err = validateTokenGroup(req.Group)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	err = model.SetTokenGroup(token.Id, req.Group)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	recordAudit(c, "token.group", "token", strconv.Itoa(token.Id), map[string]any{"group": token.Group}, map[string]any{"group": req.Group})
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+	})
+	return
+}
@@ -317,7 +317,7 @@ func UpdateUser(c *gin.Context) {
 		})
 		return
 	}
-	originUser, err := model.GetUserById(updatedUser.Id, false)
+	originUser, err := model.GetUserById(updatedUser.Id, true)
 	if err != nil {
 		c.JSON(http.StatusOK, gin.H{
 			"success": false,
@@ -351,6 +351,9 @@ func UpdateUser(c *gin.Context) {
 		})
 		return
 	}
+	if user, err := model.GetUserById(updatedUser.Id, true); err == nil {
+		recordAudit(c, "user.update", "user", strconv.Itoa(user.Id), originUser, user)
+	}
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"message": "",
@@ -414,7 +417,7 @@ func DeleteUser(c *gin.Context) {
 		})
 		return
 	}
-	originUser, err := model.GetUserById(id, false)
+	originUser, err := model.GetUserById(id, true)
 	if err != nil {
 		c.JSON(http.StatusOK, gin.H{
 			"success": false,
@@ -431,6 +434,9 @@ func DeleteUser(c *gin.Context) {
 		return
 	}
 	err = model.DeleteUserById(id)
+	if err == nil {
+		recordAudit(c, "user.delete", "user", strconv.Itoa(id), originUser, nil)
+	}
 	if err != nil {
 		c.JSON(http.StatusOK, gin.H{
 			"success": true,
@@ -498,6 +504,7 @@ func CreateUser(c *gin.Context) {
 		})
 		return
 	}
+	recordAudit(c, "user.create", "user", strconv.Itoa(cleanUser.Id), nil, &cleanUser)
 
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
@@ -543,6 +550,7 @@ func ManageUser(c *gin.Context) {
 		})
 		return
 	}
+	originUser := user
 	switch req.Action {
 	case "disable":
 		user.Status = common.UserStatusDisabled
@@ -611,6 +619,11 @@ func ManageUser(c *gin.Context) {
 		})
 		return
 	}
+	if req.Action == "delete" {
+		recordAudit(c, "user.delete", "user", strconv.Itoa(user.Id), &originUser, nil)
+	} else {
+		recordAudit(c, "user."+req.Action, "user", strconv.Itoa(user.Id), &originUser, &user)
+	}
 	clearUser := model.User{
 		Role:   user.Role,
 		Status: user.Status,
@@ -695,3 +708,51 @@ func TopUp(c *gin.Context) {
 	})
 	return
 }
+
+func GetSelfBudget(c *gin.Context) {
+	id := c.GetInt("id")
+	budget, err := model.GetUserBudget(id)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	if budget == nil {
+		budget = &model.UserBudget{UserId: id}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    budget,
+	})
+	return
+}
+
+func UpdateSelfBudget(c *gin.Context) {
+	var budget model.UserBudget
+	err := json.NewDecoder(c.Request.Body).Decode(&budget)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": "无效的参数",
+		})
+		return
+	}
+	budget.UserId = c.GetInt("id")
+	err = model.SetUserBudget(&budget)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    budget,
+	})
+	return
+}
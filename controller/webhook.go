@@ -0,0 +1,192 @@
+package controller
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/url"
+	"one-api/common"
+	"one-api/model"
+	"strconv"
+)
+
+func GetAllWebhookSubscriptions(c *gin.Context) {
+	subscriptions, err := model.GetAllWebhookSubscriptions()
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	for _, subscription := range subscriptions {
+		subscription.RedactSecret()
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    subscriptions,
+	})
+	return
+}
+
+func validateWebhookSubscription(subscription *model.WebhookSubscription) string {
+	u, err := url.Parse(subscription.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "无效的回调地址"
+	}
+	if subscription.Events == "" {
+		return "请选择要订阅的事件"
+	}
+	err = model.ValidateWebhookEvents(subscription.Events)
+	if err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func AddWebhookSubscription(c *gin.Context) {
+	subscription := model.WebhookSubscription{}
+	err := c.ShouldBindJSON(&subscription)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	if message := validateWebhookSubscription(&subscription); message != "" {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": message,
+		})
+		return
+	}
+	if subscription.Secret == "" {
+		subscription.Secret = common.GetUUID()
+	}
+	subscription.Id = 0
+	subscription.Status = common.WebhookStatusEnabled
+	subscription.CreatedTime = common.GetTimestamp()
+	err = subscription.Insert()
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    subscription,
+	})
+	return
+}
+
+func UpdateWebhookSubscription(c *gin.Context) {
+	subscription := model.WebhookSubscription{}
+	err := c.ShouldBindJSON(&subscription)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	cleanSubscription, err := model.GetWebhookSubscriptionById(subscription.Id)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	if message := validateWebhookSubscription(&subscription); message != "" {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": message,
+		})
+		return
+	}
+	if subscription.Status != common.WebhookStatusEnabled && subscription.Status != common.WebhookStatusDisabled {
+		subscription.Status = cleanSubscription.Status
+	}
+	cleanSubscription.Name = subscription.Name
+	cleanSubscription.URL = subscription.URL
+	cleanSubscription.Events = subscription.Events
+	cleanSubscription.Status = subscription.Status
+	cleanSubscription.SetSecret(subscription.Secret)
+	err = cleanSubscription.Update()
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	cleanSubscription.RedactSecret()
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    cleanSubscription,
+	})
+	return
+}
+
+func DeleteWebhookSubscription(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	subscription := model.WebhookSubscription{Id: id}
+	err := subscription.Delete()
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+	})
+	return
+}
+
+func GetWebhookDeliveries(c *gin.Context) {
+	p, _ := strconv.Atoi(c.Query("p"))
+	if p < 0 {
+		p = 0
+	}
+	subscriptionId, _ := strconv.Atoi(c.Query("subscription_id"))
+	status, _ := strconv.Atoi(c.Query("status"))
+	deliveries, err := model.GetWebhookDeliveries(subscriptionId, status, p*common.ItemsPerPage, common.ItemsPerPage)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    deliveries,
+	})
+	return
+}
+
+func RedeliverWebhook(c *gin.Context) {
+	id, _ := strconv.Atoi(c.Param("id"))
+	err := model.RedeliverWebhook(id)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+	})
+	return
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"embed"
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-contrib/sessions/cookie"
@@ -8,6 +9,8 @@ import (
 	"github.com/gin-gonic/gin"
 	"log"
 	"one-api/common"
+	"one-api/common/tracing"
+	"one-api/controller"
 	"one-api/middleware"
 	"one-api/model"
 	"one-api/router"
@@ -22,6 +25,7 @@ var buildFS embed.FS
 var indexPage []byte
 
 func main() {
+	common.ParseFlags()
 	common.SetupGinLog()
 	common.SysLog("One API " + common.Version + " started")
 	if os.Getenv("GIN_MODE") != "debug" {
@@ -38,6 +42,26 @@ func main() {
 			common.FatalLog(err)
 		}
 	}()
+	if *common.RotateMasterKey {
+		err = model.RotateMasterKey()
+		if err != nil {
+			common.FatalLog(err)
+		}
+		common.SysLog("master key rotated, please restart with the new MASTER_KEY")
+		return
+	}
+
+	// Initialize tracing
+	shutdownTracing, err := tracing.InitTracing()
+	if err != nil {
+		common.FatalLog(err)
+	}
+	defer func() {
+		err := shutdownTracing(context.Background())
+		if err != nil {
+			common.SysError("failed to shutdown tracing: " + err.Error())
+		}
+	}()
 
 	// Initialize Redis
 	err = common.InitRedisClient()
@@ -54,9 +78,34 @@ func main() {
 		}
 		go model.SyncOptions(frequency)
 	}
+	controller.InitChannelBreakers()
+	go model.AutomaticallyResetTokenPeriodQuotas(60)
+	go model.ProcessWebhookDeliveries(5)
+	go model.AutomaticallyPurgeContentLogs(60 * 60)
+	go model.AutomaticallyCleanExpiredLogs(60 * 60)
+	go model.SyncChannelKeys(10)
+	go model.FlushUsageStats(5)
+	if os.Getenv("CHANNEL_TEST_FREQUENCY") != "" {
+		frequency, err := strconv.Atoi(os.Getenv("CHANNEL_TEST_FREQUENCY"))
+		if err != nil {
+			common.FatalLog(err)
+		}
+		go controller.AutomaticallyTestChannels(frequency)
+	}
 
 	// Initialize HTTP server
-	server := gin.Default()
+	server := gin.New()
+	server.Use(gin.Recovery(), middleware.RequestId(), middleware.AccessLog())
+	if common.TrustedProxies != nil {
+		err = server.SetTrustedProxies(common.TrustedProxies)
+		if err != nil {
+			common.FatalLog(err)
+		}
+	} else {
+		// kept trusting all proxies as before so the deployments behind a reverse proxy keep the real client IPs
+		common.LogWarn(context.Background(), "TRUSTED_PROXIES is not set, the X-Forwarded-For header of any client is trusted, "+
+			"so the client IP used by the rate limits and the token IP allowlists can be spoofed")
+	}
 	// This will cause SSE not to work!!!
 	//server.Use(gzip.Gzip(gzip.DefaultCompression))
 	server.Use(middleware.CORS())
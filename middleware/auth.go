@@ -1,10 +1,14 @@
 package middleware
 
 import (
+	"crypto/subtle"
+	"fmt"
 	"github.com/gin-contrib/sessions"
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
 	"net/http"
 	"one-api/common"
+	"one-api/common/tracing"
 	"one-api/model"
 	"strings"
 )
@@ -84,6 +88,8 @@ func RootAuth() func(c *gin.Context) {
 
 func TokenAuth() func(c *gin.Context) {
 	return func(c *gin.Context) {
+		_, span := tracing.StartSpan(c, "TokenAuth")
+		defer tracing.EndSpan(c, span)
 		key := c.Request.Header.Get("Authorization")
 		key = strings.TrimPrefix(key, "Bearer ")
 		key = strings.TrimPrefix(key, "sk-")
@@ -93,7 +99,7 @@ func TokenAuth() func(c *gin.Context) {
 		if err != nil {
 			c.JSON(http.StatusOK, gin.H{
 				"error": gin.H{
-					"message": err.Error(),
+					"message": common.MessageWithRequestId(c, err.Error()),
 					"type":    "one_api_error",
 				},
 			})
@@ -103,15 +109,31 @@ func TokenAuth() func(c *gin.Context) {
 		if !model.IsUserEnabled(token.UserId) {
 			c.JSON(http.StatusOK, gin.H{
 				"error": gin.H{
-					"message": "User has been banned",
+					"message": common.MessageWithRequestId(c, "User has been banned"),
 					"type":    "one_api_error",
 				},
 			})
 			c.Abort()
 			return
 		}
+		if !token.IsIpAllowed(c.ClientIP()) {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": gin.H{
+					"message": common.MessageWithRequestId(c, fmt.Sprintf("This API key is not allowed to be used from IP %s", c.ClientIP())),
+					"type":    "permission_error",
+					"code":    "ip_not_allowed",
+				},
+			})
+			c.Abort()
+			return
+		}
 		c.Set("id", token.UserId)
 		c.Set("token_id", token.Id)
+		c.Set("token_models", token.Models)
+		c.Set("token_group", token.Group)
+		c.Set("token_rpm", token.RateLimitRPM)
+		c.Set("token_tpm", token.RateLimitTPM)
+		c.Set("token_content_logging", token.ContentLogging)
 		requestURL := c.Request.URL.String()
 		consumeQuota := true
 		if strings.HasPrefix(requestURL, "/v1/models") {
@@ -124,7 +146,7 @@ func TokenAuth() func(c *gin.Context) {
 			} else {
 				c.JSON(http.StatusOK, gin.H{
 					"error": gin.H{
-						"message": "Ordinary users do not support specified channels",
+						"message": common.MessageWithRequestId(c, "Ordinary users do not support specified channels"),
 						"type":    "one_api_error",
 					},
 				})
@@ -132,6 +154,26 @@ func TokenAuth() func(c *gin.Context) {
 				return
 			}
 		}
+		span.SetAttributes(attribute.Int("one_api.user_id", token.UserId), attribute.Int("one_api.token_id", token.Id))
+		tracing.EndSpan(c, span)
+		c.Next()
+	}
+}
+
+// MetricsAuth checks the bearer token of /metrics, the endpoint is not found if MetricsToken is not set
+func MetricsAuth() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		if common.MetricsToken == "" {
+			c.Status(http.StatusNotFound)
+			c.Abort()
+			return
+		}
+		key := strings.TrimPrefix(c.Request.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(key), []byte(common.MetricsToken)) != 1 {
+			c.Status(http.StatusUnauthorized)
+			c.Abort()
+			return
+		}
 		c.Next()
 	}
 }
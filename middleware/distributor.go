@@ -1,28 +1,62 @@
 package middleware
 
 import (
+	"context"
 	"fmt"
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
 	"net/http"
 	"one-api/common"
+	"one-api/common/tracing"
 	"one-api/model"
 	"strconv"
 )
 
 type ModelRequest struct {
-	Model string `json:"model"`
+	Model  string `json:"model"`
+	Stream bool   `json:"stream"`
 }
 
 func Distribute() func(c *gin.Context) {
 	return func(c *gin.Context) {
+		_, span := tracing.StartSpan(c, "Distribute")
+		defer tracing.EndSpan(c, span)
 		var channel *model.Channel
+		var channelKey *model.ChannelKey
 		channelId, ok := c.Get("channelId")
+		tokenModels := c.GetString("token_models")
+		var modelRequest ModelRequest
+		if !ok || tokenModels != "" {
+			err := common.UnmarshalBodyReusable(c, &modelRequest)
+			if err != nil {
+				c.JSON(200, gin.H{
+					"error": gin.H{
+						"message": common.MessageWithRequestId(c, "无效的请求"),
+						"type":    "one_api_error",
+					},
+				})
+				c.Abort()
+				return
+			}
+		}
+		if !common.IsModelAllowed(tokenModels, modelRequest.Model) {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": gin.H{
+					"message": common.MessageWithRequestId(c, fmt.Sprintf("The model `%s` does not exist or you do not have access to it.", modelRequest.Model)),
+					"type":    "invalid_request_error",
+					"param":   "model",
+					"code":    "model_not_found",
+				},
+			})
+			c.Abort()
+			return
+		}
 		if ok {
 			id, err := strconv.Atoi(channelId.(string))
 			if err != nil {
 				c.JSON(http.StatusOK, gin.H{
 					"error": gin.H{
-						"message": "无效的渠道 ID",
+						"message": common.MessageWithRequestId(c, "无效的渠道 ID"),
 						"type":    "one_api_error",
 					},
 				})
@@ -33,7 +67,7 @@ func Distribute() func(c *gin.Context) {
 			if err != nil {
 				c.JSON(200, gin.H{
 					"error": gin.H{
-						"message": "无效的渠道 ID",
+						"message": common.MessageWithRequestId(c, "无效的渠道 ID"),
 						"type":    "one_api_error",
 					},
 				})
@@ -43,7 +77,30 @@ func Distribute() func(c *gin.Context) {
 			if channel.Status != common.ChannelStatusEnabled {
 				c.JSON(200, gin.H{
 					"error": gin.H{
-						"message": "该渠道已被禁用",
+						"message": common.MessageWithRequestId(c, "该渠道已被禁用"),
+						"type":    "one_api_error",
+					},
+				})
+				c.Abort()
+				return
+			}
+			if !channel.TryAcquire(c.Request.Context()) {
+				c.JSON(http.StatusTooManyRequests, gin.H{
+					"error": gin.H{
+						"message": common.MessageWithRequestId(c, "该渠道已达到并发或速率限制，请稍后再试"),
+						"type":    "one_api_error",
+						"code":    "channel_saturated",
+					},
+				})
+				c.Abort()
+				return
+			}
+			channelKey, err = channel.SelectKey()
+			if err != nil {
+				channel.Release(context.Background())
+				c.JSON(http.StatusOK, gin.H{
+					"error": gin.H{
+						"message": common.MessageWithRequestId(c, err.Error()),
 						"type":    "one_api_error",
 					},
 				})
@@ -52,42 +109,85 @@ func Distribute() func(c *gin.Context) {
 			}
 		} else {
 			// Select a channel for the user
-			var modelRequest ModelRequest
-			err := common.UnmarshalBodyReusable(c, &modelRequest)
-			if err != nil {
+			userGroup := c.GetString("token_group")
+			if userGroup == "" {
+				userId := c.GetInt("id")
+				userGroup, _ = model.GetUserGroup(userId)
+			}
+			channels, err := model.GetSatisfiedChannels(userGroup, modelRequest.Model)
+			if err != nil || len(channels) == 0 {
 				c.JSON(200, gin.H{
 					"error": gin.H{
-						"message": "无效的请求",
+						"message": common.MessageWithRequestId(c, "无可用渠道"),
 						"type":    "one_api_error",
 					},
 				})
 				c.Abort()
 				return
 			}
-			userId := c.GetInt("id")
-			userGroup, _ := model.GetUserGroup(userId)
-			channel, err = model.GetRandomSatisfiedChannel(userGroup, modelRequest.Model)
-			if err != nil {
-				c.JSON(200, gin.H{
+			// Try the channels in the order of the routing strategy of the group,
+			// skip the channels at their limits and fall through to the next one
+			strategy := common.GetGroupRoutingStrategy(userGroup)
+			switch common.ChannelAffinityMode {
+			case common.ChannelAffinityModeUser:
+				strategy = "affinity_user"
+				model.SortChannelsByAffinity(channels, fmt.Sprintf("user:%d:%s", c.GetInt("id"), modelRequest.Model))
+			case common.ChannelAffinityModeToken:
+				strategy = "affinity_token"
+				model.SortChannelsByAffinity(channels, fmt.Sprintf("token:%d:%s", c.GetInt("token_id"), modelRequest.Model))
+			default:
+				model.SortChannelsByStrategy(c.Request.Context(), channels, strategy, modelRequest.Model, modelRequest.Stream)
+			}
+			c.Set("routing_strategy", strategy)
+			for _, candidate := range channels {
+				if !candidate.TryAcquire(c.Request.Context()) {
+					continue
+				}
+				channelKey, err = candidate.SelectKey()
+				if err != nil {
+					candidate.Release(context.Background())
+					continue
+				}
+				channel = candidate
+				break
+			}
+			if channel == nil {
+				c.JSON(http.StatusTooManyRequests, gin.H{
 					"error": gin.H{
-						"message": "无可用渠道",
+						"message": common.MessageWithRequestId(c, "所有可用渠道都已达到并发或速率限制，请稍后再试"),
 						"type":    "one_api_error",
+						"code":    "channel_saturated",
 					},
 				})
 				c.Abort()
 				return
 			}
 		}
+		defer channel.Release(context.Background())
+		if channel.RateLimitTPM > 0 {
+			tpmLimits, ok := c.Get("tpm_rate_limits")
+			if !ok {
+				tpmLimits = make(map[string]int)
+				c.Set("tpm_rate_limits", tpmLimits)
+			}
+			tpmLimits.(map[string]int)[model.ChannelTPMKey(channel.Id)] = channel.RateLimitTPM
+		}
 		c.Set("channel", channel.Type)
 		c.Set("channel_id", channel.Id)
 		c.Set("channel_name", channel.Name)
-		c.Request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", channel.Key))
+		c.Set("channel_key_id", channelKey.Id)
+		c.Request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", channelKey.Key))
 		if channel.Type == common.ChannelTypeCustom || channel.Type == common.ChannelTypeAzure {
 			c.Set("base_url", channel.BaseURL)
 			if channel.Type == common.ChannelTypeAzure {
 				c.Set("api_version", channel.Other)
 			}
 		}
+		span.SetAttributes(
+			attribute.Int("one_api.channel_id", channel.Id),
+			attribute.String("one_api.routing_strategy", c.GetString("routing_strategy")),
+		)
+		tracing.EndSpan(c, span)
 		c.Next()
 	}
 }
@@ -1,83 +1,41 @@
 package middleware
 
 import (
-	"context"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"net/http"
 	"one-api/common"
+	"one-api/common/limiter"
+	"one-api/common/metrics"
+	"one-api/model"
+	"strconv"
 	"time"
 )
 
-var timeFormat = "2006-01-02T15:04:05.000Z"
-
-var inMemoryRateLimiter common.InMemoryRateLimiter
+// the names of the limiters in metrics
+var rateLimitNames = map[string]string{
+	"GW": "global_web",
+	"GA": "global_api",
+	"CT": "critical",
+	"DW": "download",
+	"UP": "upload",
+}
 
-func redisRateLimiter(c *gin.Context, maxRequestNum int, duration int64, mark string) {
-	ctx := context.Background()
-	rdb := common.RDB
-	key := "rateLimit:" + mark + c.ClientIP()
-	listLength, err := rdb.LLen(ctx, key).Result()
-	if err != nil {
-		fmt.Println(err.Error())
-		c.Status(http.StatusInternalServerError)
-		c.Abort()
-		return
-	}
-	if listLength < int64(maxRequestNum) {
-		rdb.LPush(ctx, key, time.Now().Format(timeFormat))
-		rdb.Expire(ctx, key, common.RateLimitKeyExpirationDuration)
-	} else {
-		oldTimeStr, _ := rdb.LIndex(ctx, key, -1).Result()
-		oldTime, err := time.Parse(timeFormat, oldTimeStr)
-		if err != nil {
-			fmt.Println(err)
-			c.Status(http.StatusInternalServerError)
-			c.Abort()
-			return
-		}
-		nowTimeStr := time.Now().Format(timeFormat)
-		nowTime, err := time.Parse(timeFormat, nowTimeStr)
+func rateLimitFactory(maxRequestNum int, duration int64, mark string) func(c *gin.Context) {
+	rateLimiter := limiter.Default()
+	return func(c *gin.Context) {
+		result, err := rateLimiter.Allow(c.Request.Context(), mark+c.ClientIP(), maxRequestNum, time.Duration(duration)*time.Second, 1)
 		if err != nil {
-			fmt.Println(err)
+			common.LogError(c, "failed to check rate limit", "limiter", rateLimitNames[mark], "error", err.Error())
 			c.Status(http.StatusInternalServerError)
 			c.Abort()
 			return
 		}
-		// time.Since will return negative number!
-		// See: https://stackoverflow.com/questions/50970900/why-is-time-since-returning-negative-durations-on-windows
-		if int64(nowTime.Sub(oldTime).Seconds()) < duration {
-			rdb.Expire(ctx, key, common.RateLimitKeyExpirationDuration)
+		if !result.Allowed {
+			metrics.RateLimitRejections.WithLabelValues(rateLimitNames[mark]).Inc()
 			c.Status(http.StatusTooManyRequests)
 			c.Abort()
 			return
-		} else {
-			rdb.LPush(ctx, key, time.Now().Format(timeFormat))
-			rdb.LTrim(ctx, key, 0, int64(maxRequestNum-1))
-			rdb.Expire(ctx, key, common.RateLimitKeyExpirationDuration)
-		}
-	}
-}
-
-func memoryRateLimiter(c *gin.Context, maxRequestNum int, duration int64, mark string) {
-	key := mark + c.ClientIP()
-	if !inMemoryRateLimiter.Request(key, maxRequestNum, duration) {
-		c.Status(http.StatusTooManyRequests)
-		c.Abort()
-		return
-	}
-}
-
-func rateLimitFactory(maxRequestNum int, duration int64, mark string) func(c *gin.Context) {
-	if common.RedisEnabled {
-		return func(c *gin.Context) {
-			redisRateLimiter(c, maxRequestNum, duration, mark)
-		}
-	} else {
-		// It's safe to call multi times.
-		inMemoryRateLimiter.Init(common.RateLimitKeyExpirationDuration)
-		return func(c *gin.Context) {
-			memoryRateLimiter(c, maxRequestNum, duration, mark)
 		}
 	}
 }
@@ -101,3 +59,123 @@ func DownloadRateLimit() func(c *gin.Context) {
 func UploadRateLimit() func(c *gin.Context) {
 	return rateLimitFactory(common.UploadRateLimitNum, common.UploadRateLimitDuration, "UP")
 }
+
+type relayRateLimit struct {
+	key string
+	rpm int
+	tpm int
+}
+
+func setRateLimitHeaders(c *gin.Context, kind string, result *limiter.Result) {
+	c.Header("x-ratelimit-limit-"+kind, strconv.Itoa(result.Limit))
+	c.Header("x-ratelimit-remaining-"+kind, strconv.Itoa(result.Remaining))
+	c.Header("x-ratelimit-reset-"+kind, result.ResetAfter.Round(time.Millisecond).String())
+}
+
+func abortWithRateLimitError(c *gin.Context, kind string, result *limiter.Result) {
+	unit := "requests per min (RPM)"
+	if kind == "tokens" {
+		unit = "tokens per min (TPM)"
+	}
+	metrics.RateLimitRejections.WithLabelValues("relay_" + kind).Inc()
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error": gin.H{
+			"message": common.MessageWithRequestId(c, fmt.Sprintf("Rate limit reached for %s: Limit %d. Please try again in %s.", unit, result.Limit, result.RetryAfter.Round(time.Millisecond).String())),
+			"type":    kind,
+			"code":    "rate_limit_exceeded",
+		},
+	})
+	c.Abort()
+}
+
+// RelayRateLimit limits the requests & tokens per minute of each token and each user.
+// User limits come from the group, which is the group of the token if it is set, otherwise the group of the user.
+// Token limits are set on the token itself, the limits of the group are used if they are not set.
+// The tokens used are recorded after the request is relayed, see "tpm_rate_limits".
+func RelayRateLimit() func(c *gin.Context) {
+	rateLimiter := limiter.Default()
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		userId := c.GetInt("id")
+		tokenId := c.GetInt("token_id")
+		group := c.GetString("token_group")
+		if group == "" {
+			group, _ = model.GetUserGroup(userId)
+		}
+		groupRateLimit := common.GetGroupRateLimit(group)
+		tokenRPM := c.GetInt("token_rpm")
+		if tokenRPM == 0 {
+			tokenRPM = groupRateLimit.RPM
+		}
+		tokenTPM := c.GetInt("token_tpm")
+		if tokenTPM == 0 {
+			tokenTPM = groupRateLimit.TPM
+		}
+		limits := []relayRateLimit{
+			{key: fmt.Sprintf("token:%d", tokenId), rpm: tokenRPM, tpm: tokenTPM},
+			{key: fmt.Sprintf("user:%d", userId), rpm: groupRateLimit.RPM, tpm: groupRateLimit.TPM},
+		}
+		var requestsResult, tokensResult *limiter.Result
+		tpmLimits := make(map[string]int)
+		// every limit is checked before the request is counted, so a request rejected by the user limit
+		// doesn't use up the token limit and the other way around
+		for _, limit := range limits {
+			if limit.tpm > 0 {
+				// The tokens are unknown yet, only check whether there are tokens left
+				result, err := rateLimiter.Allow(ctx, "TPM:"+limit.key, limit.tpm, time.Minute, 0)
+				if err != nil {
+					common.LogError(c, "failed to check tpm limit", "key", limit.key, "error", err.Error())
+				} else {
+					if !result.Allowed {
+						setRateLimitHeaders(c, "tokens", result)
+						abortWithRateLimitError(c, "tokens", result)
+						return
+					}
+					if tokensResult == nil || result.Remaining < tokensResult.Remaining {
+						tokensResult = result
+					}
+				}
+				tpmLimits["TPM:"+limit.key] = limit.tpm
+			}
+			if limit.rpm > 0 {
+				result, err := rateLimiter.Allow(ctx, "RPM:"+limit.key, limit.rpm, time.Minute, 0)
+				if err != nil {
+					common.LogError(c, "failed to check rpm limit", "key", limit.key, "error", err.Error())
+					continue
+				}
+				if !result.Allowed {
+					setRateLimitHeaders(c, "requests", result)
+					abortWithRateLimitError(c, "requests", result)
+					return
+				}
+			}
+		}
+		for _, limit := range limits {
+			if limit.rpm <= 0 {
+				continue
+			}
+			result, err := rateLimiter.Allow(ctx, "RPM:"+limit.key, limit.rpm, time.Minute, 1)
+			if err != nil {
+				common.LogError(c, "failed to check rpm limit", "key", limit.key, "error", err.Error())
+				continue
+			}
+			if !result.Allowed {
+				// used up by concurrent requests since the check
+				setRateLimitHeaders(c, "requests", result)
+				abortWithRateLimitError(c, "requests", result)
+				return
+			}
+			if requestsResult == nil || result.Remaining < requestsResult.Remaining {
+				requestsResult = result
+			}
+		}
+		if requestsResult != nil {
+			setRateLimitHeaders(c, "requests", requestsResult)
+		}
+		if tokensResult != nil {
+			setRateLimitHeaders(c, "tokens", tokensResult)
+		}
+		c.Set("tpm_rate_limits", tpmLimits)
+		c.Next()
+	}
+}
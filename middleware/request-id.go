@@ -0,0 +1,63 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+	"one-api/common"
+	"time"
+)
+
+const requestIdHeader = "X-Request-Id"
+
+func isValidRequestId(requestId string) bool {
+	if requestId == "" || len(requestId) > 64 {
+		return false
+	}
+	for _, c := range requestId {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// RequestId accepts the X-Request-Id of the client or generates one, it is returned in the response header
+func RequestId() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		requestId := c.GetHeader(requestIdHeader)
+		if !isValidRequestId(requestId) {
+			requestId = common.GetUUID()
+		}
+		c.Set(common.RequestIdKey, requestId)
+		c.Header(requestIdHeader, requestId)
+		c.Next()
+	}
+}
+
+// AccessLog logs every request with the leveled logger, replacing the access log of gin
+func AccessLog() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		start := time.Now()
+		path := c.Request.URL.Path
+		c.Next()
+		fields := []any{
+			"method", c.Request.Method,
+			"path", path,
+			"status", c.Writer.Status(),
+			"latency", time.Since(start).String(),
+			"ip", c.ClientIP(),
+		}
+		if userId := c.GetInt("id"); userId != 0 {
+			fields = append(fields, "user_id", userId)
+		}
+		if tokenId := c.GetInt("token_id"); tokenId != 0 {
+			fields = append(fields, "token_id", tokenId)
+		}
+		if channelId := c.GetInt("channel_id"); channelId != 0 {
+			fields = append(fields, "channel_id", channelId)
+		}
+		if len(c.Errors) > 0 {
+			fields = append(fields, "errors", c.Errors.String())
+		}
+		common.LogInfo(c, "request", fields...)
+	}
+}
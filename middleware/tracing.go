@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"one-api/common"
+	"one-api/common/tracing"
+)
+
+// Tracing starts the server span of the request, continuing the trace of the incoming traceparent header
+func Tracing() func(c *gin.Context) {
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+		ctx, span := tracing.Tracer.Start(ctx, c.Request.Method+" "+c.FullPath(),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPMethod(c.Request.Method),
+				semconv.HTTPRoute(c.FullPath()),
+				attribute.String("one_api.request_id", c.GetString(common.RequestIdKey)),
+			))
+		defer span.End()
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+		status := c.Writer.Status()
+		span.SetAttributes(
+			semconv.HTTPStatusCode(status),
+			attribute.Int("one_api.user_id", c.GetInt("id")),
+			attribute.Int("one_api.token_id", c.GetInt("token_id")),
+			attribute.Int("one_api.channel_id", c.GetInt("channel_id")),
+			attribute.String("one_api.model", c.GetString("relay_model")),
+		)
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
@@ -12,23 +12,30 @@ type Ability struct {
 	Enabled   bool   `json:"enabled"`
 }
 
-func GetRandomSatisfiedChannel(group string, model string) (*Channel, error) {
+// IsGroupServed reports whether any channel serves the group
+func IsGroupServed(group string) (bool, error) {
+	var count int64
+	err := DB.Model(&Ability{}).Where("`group` = ?", group).Count(&count).Error
+	return count > 0, err
+}
+
+// GetSatisfiedChannels returns all enabled channels of the group that serve the model
+func GetSatisfiedChannels(group string, model string) ([]*Channel, error) {
+	var channels []*Channel
 	if group == "default" {
-		return GetRandomChannel()
-	}
-	ability := Ability{}
-	var err error = nil
-	if common.UsingSQLite {
-		err = DB.Where("`group` = ? and model = ? and enabled = 1", group, model).Order("RANDOM()").Limit(1).First(&ability).Error
-	} else {
-		err = DB.Where("`group` = ? and model = ? and enabled = 1", group, model).Order("RAND()").Limit(1).First(&ability).Error
+		err := DB.Where("status = ? and `group` = ?", common.ChannelStatusEnabled, "default").Find(&channels).Error
+		return channels, err
 	}
+	var channelIds []int
+	err := DB.Model(&Ability{}).Where("`group` = ? and model = ? and enabled = ?", group, model, true).Pluck("channel_id", &channelIds).Error
 	if err != nil {
 		return nil, err
 	}
-	channel := Channel{}
-	err = DB.First(&channel, "id = ?", ability.ChannelId).Error
-	return &channel, err
+	if len(channelIds) == 0 {
+		return channels, nil
+	}
+	err = DB.Where("id in ?", channelIds).Find(&channels).Error
+	return channels, err
 }
 
 func (channel *Channel) AddAbilities() error {
@@ -0,0 +1,19 @@
+package model
+
+import "testing"
+
+func TestIsGroupServed(t *testing.T) {
+	channel := &Channel{Name: "served", Key: "sk-served", Models: "gpt-3.5-turbo", Group: "served-group"}
+	err := channel.Insert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	served, err := IsGroupServed("served-group")
+	if err != nil || !served {
+		t.Errorf("served = %v, err = %v, want the group of the channel served", served, err)
+	}
+	served, err = IsGroupServed("typo-group")
+	if err != nil || served {
+		t.Errorf("served = %v, err = %v, want a group without channels not served", served, err)
+	}
+}
@@ -0,0 +1,138 @@
+package model
+
+import (
+	"encoding/json"
+	"one-api/common"
+	"reflect"
+	"strings"
+)
+
+// AuditLog records a management action, Before and After hold the changed fields as JSON with the secrets redacted
+type AuditLog struct {
+	Id         int    `json:"id"`
+	ActorId    int    `json:"actor_id" gorm:"index"`
+	ActorName  string `json:"actor_name"`
+	Action     string `json:"action" gorm:"type:varchar(64);index"`
+	TargetType string `json:"target_type" gorm:"type:varchar(32);index"`
+	TargetId   string `json:"target_id" gorm:"type:varchar(64);index"`
+	Before     string `json:"before" gorm:"type:text"`
+	After      string `json:"after" gorm:"type:text"`
+	Ip         string `json:"ip"`
+	RequestId  string `json:"request_id" gorm:"type:varchar(64)"`
+	CreatedAt  int64  `json:"created_at" gorm:"bigint;index"`
+}
+
+const redactedValue = "[REDACTED]"
+
+// the fields which are never written to the audit log
+var secretFields = map[string]bool{
+	"key":               true,
+	"keys":              true,
+	"password":          true,
+	"access_token":      true,
+	"secret":            true,
+	"verification_code": true,
+}
+
+// IsSecretOption returns true if the value of the option should not be shown
+func IsSecretOption(key string) bool {
+	return secretOptions[key] || strings.Contains(key, "Token") || strings.Contains(key, "Secret")
+}
+
+func toAuditFields(v any) map[string]any {
+	if v == nil {
+		return nil
+	}
+	if value := reflect.ValueOf(v); (value.Kind() == reflect.Ptr || value.Kind() == reflect.Map) && value.IsNil() {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	fields := make(map[string]any)
+	if json.Unmarshal(data, &fields) != nil {
+		// not an object, e.g. the value of an option
+		return map[string]any{"value": v}
+	}
+	return fields
+}
+
+func redactAuditFields(fields map[string]any) {
+	for name, value := range fields {
+		if secretFields[name] && value != nil && value != "" {
+			fields[name] = redactedValue
+		}
+	}
+}
+
+// auditDiff returns the fields which changed, all the fields are kept if one side is nil (created or deleted),
+// the secrets are compared before they are redacted so their changes are still recorded
+func auditDiff(before any, after any) (map[string]any, map[string]any) {
+	beforeFields := toAuditFields(before)
+	afterFields := toAuditFields(after)
+	if beforeFields != nil && afterFields != nil {
+		for name, value := range beforeFields {
+			if afterValue, ok := afterFields[name]; ok && reflect.DeepEqual(value, afterValue) {
+				delete(beforeFields, name)
+				delete(afterFields, name)
+			}
+		}
+	}
+	redactAuditFields(beforeFields)
+	redactAuditFields(afterFields)
+	return beforeFields, afterFields
+}
+
+func auditJSON(fields map[string]any) string {
+	if fields == nil {
+		return ""
+	}
+	data, _ := json.Marshal(fields)
+	return string(data)
+}
+
+// RecordAuditLog writes the log with the diff of before & after, nil means the target didn't exist or was deleted
+func RecordAuditLog(log *AuditLog, before any, after any) {
+	beforeFields, afterFields := auditDiff(before, after)
+	log.Before = auditJSON(beforeFields)
+	log.After = auditJSON(afterFields)
+	log.CreatedAt = common.GetTimestamp()
+	err := DB.Create(log).Error
+	if err != nil {
+		common.SysError("failed to record audit log: " + err.Error())
+	}
+}
+
+type AuditLogFilter struct {
+	ActorId        int
+	Action         string
+	TargetType     string
+	TargetId       string
+	StartTimestamp int64
+	EndTimestamp   int64
+}
+
+func GetAuditLogs(filter *AuditLogFilter, startIdx int, num int) (logs []*AuditLog, err error) {
+	tx := DB.Order("id desc")
+	if filter.ActorId != 0 {
+		tx = tx.Where("actor_id = ?", filter.ActorId)
+	}
+	if filter.Action != "" {
+		tx = tx.Where("action = ?", filter.Action)
+	}
+	if filter.TargetType != "" {
+		tx = tx.Where("target_type = ?", filter.TargetType)
+	}
+	if filter.TargetId != "" {
+		tx = tx.Where("target_id = ?", filter.TargetId)
+	}
+	if filter.StartTimestamp != 0 {
+		tx = tx.Where("created_at >= ?", filter.StartTimestamp)
+	}
+	if filter.EndTimestamp != 0 {
+		tx = tx.Where("created_at <= ?", filter.EndTimestamp)
+	}
+	err = tx.Limit(num).Offset(startIdx).Find(&logs).Error
+	return logs, err
+}
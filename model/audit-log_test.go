@@ -0,0 +1,72 @@
+package model
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAuditDiffRedactsSecrets(t *testing.T) {
+	before := &User{Id: 1, Username: "alice", Password: "old-password", AccessToken: "old-token", Quota: 100}
+	after := &User{Id: 1, Username: "alice", Password: "new-password", AccessToken: "old-token", Quota: 200}
+	beforeFields, afterFields := auditDiff(before, after)
+	if _, ok := afterFields["username"]; ok {
+		t.Error("the unchanged fields should be dropped")
+	}
+	if _, ok := afterFields["access_token"]; ok {
+		t.Error("the unchanged secrets should be dropped")
+	}
+	if beforeFields["password"] != redactedValue || afterFields["password"] != redactedValue {
+		t.Errorf("password = %v -> %v, want the change recorded as redacted", beforeFields["password"], afterFields["password"])
+	}
+	if beforeFields["quota"] != float64(100) || afterFields["quota"] != float64(200) {
+		t.Errorf("quota = %v -> %v, want 100 -> 200", beforeFields["quota"], afterFields["quota"])
+	}
+	for _, fields := range []map[string]any{beforeFields, afterFields} {
+		data := auditJSON(fields)
+		if strings.Contains(data, "old-password") || strings.Contains(data, "new-password") {
+			t.Errorf("the secret leaked into the audit log: %s", data)
+		}
+	}
+}
+
+func TestAuditDiffCreatedAndDeleted(t *testing.T) {
+	channel := &Channel{Id: 1, Name: "created", Key: "sk-created"}
+	beforeFields, afterFields := auditDiff(nil, channel)
+	if beforeFields != nil {
+		t.Errorf("before = %v, want nil for a created target", beforeFields)
+	}
+	if afterFields["name"] != "created" || afterFields["key"] != redactedValue {
+		t.Errorf("after = %v, want all the fields with the key redacted", afterFields)
+	}
+	var deleted *Channel
+	beforeFields, afterFields = auditDiff(channel, deleted)
+	if afterFields != nil {
+		t.Errorf("after = %v, want nil for a deleted target", afterFields)
+	}
+	if beforeFields["key"] != redactedValue {
+		t.Errorf("key = %v, want it redacted", beforeFields["key"])
+	}
+}
+
+func TestAuditDiffKeepsEmptySecrets(t *testing.T) {
+	beforeFields, afterFields := auditDiff(map[string]any{"key": ""}, map[string]any{"key": "sk-new"})
+	if beforeFields["key"] != "" {
+		t.Errorf("key = %v, want an empty key to be shown as set", beforeFields["key"])
+	}
+	if afterFields["key"] != redactedValue {
+		t.Errorf("key = %v, want it redacted", afterFields["key"])
+	}
+}
+
+func TestIsSecretOption(t *testing.T) {
+	for _, key := range []string{"SMTPToken", "GitHubClientSecret", "NotificationSinks", "SomeNewToken"} {
+		if !IsSecretOption(key) {
+			t.Errorf("%s should be a secret option", key)
+		}
+	}
+	for _, key := range []string{"QuotaPerUnit", "ContentLogMaxSize"} {
+		if IsSecretOption(key) {
+			t.Errorf("%s should not be a secret option", key)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package model
+
+import (
+	"gorm.io/gorm"
+	"math"
+	"one-api/common"
+	"sort"
+)
+
+const (
+	ChannelHealthSourceTest  = 1
+	ChannelHealthSourceRelay = 2
+)
+
+// ChannelHealth is a record of a channel test, or a sampled relay request
+type ChannelHealth struct {
+	Id             int    `json:"id"`
+	ChannelId      int    `json:"channel_id" gorm:"index"`
+	Model          string `json:"model"`
+	Source         int    `json:"source"`
+	Success        bool   `json:"success"`
+	ResponseTime   int    `json:"response_time"`    // in milliseconds
+	FirstTokenTime int    `json:"first_token_time"` // in milliseconds, only for stream relay requests
+	Message        string `json:"message"`
+	CreatedAt      int64  `json:"created_at" gorm:"bigint;index"`
+}
+
+type ChannelLatencyStat struct {
+	ChannelId       int     `json:"channel_id"`
+	Model           string  `json:"model"`
+	Count           int     `json:"count"`
+	ErrorRate       float64 `json:"error_rate"`
+	P50             int     `json:"p50"`
+	P95             int     `json:"p95"`
+	P99             int     `json:"p99"`
+	FirstTokenCount int     `json:"first_token_count"`
+	FirstTokenP50   int     `json:"first_token_p50"`
+	FirstTokenP95   int     `json:"first_token_p95"`
+	FirstTokenP99   int     `json:"first_token_p99"`
+}
+
+func RecordChannelHealth(channelId int, model string, source int, success bool, responseTime int64, firstTokenTime int64, message string) {
+	health := &ChannelHealth{
+		ChannelId:      channelId,
+		Model:          model,
+		Source:         source,
+		Success:        success,
+		ResponseTime:   int(responseTime),
+		FirstTokenTime: int(firstTokenTime),
+		Message:        message,
+		CreatedAt:      common.GetTimestamp(),
+	}
+	err := DB.Create(health).Error
+	if err != nil {
+		common.SysError("failed to record channel health: " + err.Error())
+	}
+}
+
+func GetChannelHealthHistory(channelId int, startIdx int, num int) (histories []*ChannelHealth, err error) {
+	err = DB.Where("channel_id = ?", channelId).Order("id desc").Limit(num).Offset(startIdx).Find(&histories).Error
+	return histories, err
+}
+
+// percentileRank is the 1-based nearest rank of the percentile among count sorted values
+func percentileRank(count int, p float64) int {
+	rank := int(math.Ceil(p / 100 * float64(count)))
+	if rank < 1 {
+		rank = 1
+	}
+	return rank
+}
+
+// latencyPercentile returns the value of the column at the percentile of the records of the query,
+// the database sorts them and returns the one at the rank so a long range is never loaded at once
+func latencyPercentile(query *gorm.DB, column string, count int, p float64) (int, error) {
+	if count == 0 {
+		return 0, nil
+	}
+	var values []int
+	err := query.Order(column).Offset(percentileRank(count, p)-1).Limit(1).Pluck(column, &values).Error
+	if err != nil || len(values) == 0 {
+		return 0, err
+	}
+	return values[0], nil
+}
+
+// GetChannelLatencyStats computes the latency percentiles & error rate of each channel and model since the timestamp,
+// channelId = 0 and model = "" means all. The counts & error rates are aggregated in the database,
+// the percentiles are picked by rank among the successful records of each channel and model.
+func GetChannelLatencyStats(channelId int, model string, since int64) ([]*ChannelLatencyStat, error) {
+	query := func() *gorm.DB {
+		tx := DB.Model(&ChannelHealth{}).Where("created_at >= ?", since)
+		if channelId != 0 {
+			tx = tx.Where("channel_id = ?", channelId)
+		}
+		if model != "" {
+			tx = tx.Where("model = ?", model)
+		}
+		return tx
+	}
+	var counts []struct {
+		ChannelId       int
+		Model           string
+		Count           int
+		Errors          int
+		Successes       int
+		FirstTokenCount int
+	}
+	err := query().Select("channel_id, model, COUNT(*) as count, " +
+		"SUM(CASE WHEN success THEN 0 ELSE 1 END) as errors, " +
+		"SUM(CASE WHEN success THEN 1 ELSE 0 END) as successes, " +
+		"SUM(CASE WHEN success AND first_token_time > 0 THEN 1 ELSE 0 END) as first_token_count").
+		Group("channel_id, model").Scan(&counts).Error
+	if err != nil {
+		return nil, err
+	}
+	percentiles := []float64{50, 95, 99}
+	stats := make([]*ChannelLatencyStat, 0, len(counts))
+	for _, count := range counts {
+		stat := &ChannelLatencyStat{ChannelId: count.ChannelId, Model: count.Model, Count: count.Count, FirstTokenCount: count.FirstTokenCount}
+		if count.Count > 0 {
+			stat.ErrorRate = float64(count.Errors) / float64(count.Count)
+		}
+		successes := func() *gorm.DB {
+			return query().Where("channel_id = ? and model = ? and success = ?", count.ChannelId, count.Model, true)
+		}
+		responseTimes := []*int{&stat.P50, &stat.P95, &stat.P99}
+		firstTokenTimes := []*int{&stat.FirstTokenP50, &stat.FirstTokenP95, &stat.FirstTokenP99}
+		for i, p := range percentiles {
+			*responseTimes[i], err = latencyPercentile(successes(), "response_time", count.Successes, p)
+			if err != nil {
+				return nil, err
+			}
+			*firstTokenTimes[i], err = latencyPercentile(successes().Where("first_token_time > ?", 0), "first_token_time", count.FirstTokenCount, p)
+			if err != nil {
+				return nil, err
+			}
+		}
+		stats = append(stats, stat)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].ChannelId != stats[j].ChannelId {
+			return stats[i].ChannelId < stats[j].ChannelId
+		}
+		return stats[i].Model < stats[j].Model
+	})
+	return stats, nil
+}
@@ -0,0 +1,59 @@
+package model
+
+import (
+	"one-api/common"
+	"testing"
+)
+
+func TestGetChannelLatencyStatsPerChannelAndModel(t *testing.T) {
+	now := common.GetTimestamp()
+	var records []*ChannelHealth
+	// a quiet channel, recorded before the busy one
+	for i := 1; i <= 10; i++ {
+		records = append(records, &ChannelHealth{ChannelId: 9001, Model: "gpt-4", Success: true, ResponseTime: i * 100, FirstTokenTime: i * 10, CreatedAt: now - 100})
+	}
+	records = append(records, &ChannelHealth{ChannelId: 9001, Model: "gpt-4", Success: false, ResponseTime: 60000, CreatedAt: now - 100})
+	for i := 0; i < 500; i++ {
+		records = append(records, &ChannelHealth{ChannelId: 9002, Model: "gpt-4", Success: true, ResponseTime: 5000, CreatedAt: now})
+	}
+	// out of the window
+	records = append(records, &ChannelHealth{ChannelId: 9001, Model: "gpt-4", Success: true, ResponseTime: 1, CreatedAt: now - 10000})
+	err := DB.CreateInBatches(records, 100).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		DB.Where("channel_id in ?", []int{9001, 9002}).Delete(&ChannelHealth{})
+	})
+
+	stats, err := GetChannelLatencyStats(9001, "", now-1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 {
+		t.Fatalf("got %d stats, want 1", len(stats))
+	}
+	stat := stats[0]
+	if stat.Count != 11 || stat.ErrorRate != 1.0/11 {
+		t.Errorf("count = %d, error rate = %f, want 11 and 1/11", stat.Count, stat.ErrorRate)
+	}
+	if stat.P50 != 500 || stat.P95 != 1000 || stat.P99 != 1000 {
+		t.Errorf("p50 = %d, p95 = %d, p99 = %d, want 500, 1000 and 1000", stat.P50, stat.P95, stat.P99)
+	}
+	if stat.FirstTokenCount != 10 || stat.FirstTokenP50 != 50 || stat.FirstTokenP99 != 100 {
+		t.Errorf("first token count = %d, p50 = %d, p99 = %d, want 10, 50 and 100", stat.FirstTokenCount, stat.FirstTokenP50, stat.FirstTokenP99)
+	}
+
+	stats, err = GetChannelLatencyStats(0, "gpt-4", now-1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stat := range stats {
+		if stat.ChannelId == 9001 && stat.P50 != 500 {
+			t.Errorf("p50 of the quiet channel = %d next to a busy one, want 500", stat.P50)
+		}
+		if stat.ChannelId == 9002 && (stat.P50 != 5000 || stat.FirstTokenCount != 0 || stat.FirstTokenP50 != 0) {
+			t.Errorf("busy channel: p50 = %d, first token count = %d, p50 = %d, want 5000, 0 and 0", stat.P50, stat.FirstTokenCount, stat.FirstTokenP50)
+		}
+	}
+}
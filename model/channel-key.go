@@ -0,0 +1,275 @@
+package model
+
+import (
+	"errors"
+	"gorm.io/gorm"
+	"one-api/common"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChannelKey is one of the upstream keys in the key pool of a channel
+type ChannelKey struct {
+	Id                 int     `json:"id"`
+	ChannelId          int     `json:"channel_id" gorm:"index"`
+	Key                string  `json:"key" gorm:"not null"`
+	Status             int     `json:"status" gorm:"default:1"`
+	StatusReason       string  `json:"status_reason"`
+	Balance            float64 `json:"balance"` // in USD
+	BalanceUpdatedTime int64   `json:"balance_updated_time" gorm:"bigint"`
+	UsedCount          int     `json:"used_count" gorm:"default:0"`
+	CreatedTime        int64   `json:"created_time" gorm:"bigint"`
+}
+
+var channelKeyCursors = make(map[int]int)
+var channelKeyCursorsLock sync.Mutex
+
+// the enabled keys of each channel, cleared when the keys change and on every sync for the changes of other nodes
+var enabledChannelKeys = make(map[int][]*ChannelKey)
+var enabledChannelKeysLock sync.RWMutex
+
+// the uses of each key not written to the database yet, a few of them may be lost on restart
+var channelKeyUses = make(map[int]int)
+var channelKeyUsesLock sync.Mutex
+
+// SplitChannelKeys splits the key field of a channel into keys, one key per line
+func SplitChannelKeys(key string) []string {
+	keys := make([]string, 0)
+	for _, k := range strings.Split(key, "\n") {
+		k = strings.TrimSpace(k)
+		if k != "" {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func maskChannelKey(key string) string {
+	if len(key) <= 8 {
+		return "****"
+	}
+	return key[:3] + "..." + key[len(key)-4:]
+}
+
+func GetChannelKeys(channelId int, selectAll bool) ([]*ChannelKey, error) {
+	var keys []*ChannelKey
+	err := DB.Where("channel_id = ?", channelId).Order("id").Find(&keys).Error
+	if err != nil {
+		return nil, err
+	}
+	if !selectAll {
+		for _, key := range keys {
+			key.Key = maskChannelKey(key.Key)
+		}
+	}
+	return keys, nil
+}
+
+func CountEnabledChannelKeys(channelId int) (int64, error) {
+	var count int64
+	err := DB.Model(&ChannelKey{}).Where("channel_id = ? and status = ?", channelId, common.ChannelKeyStatusEnabled).Count(&count).Error
+	return count, err
+}
+
+// ReplaceKeys makes the key pool of the channel match the given keys,
+// existing keys keep their status, balance and usage
+func (channel *Channel) ReplaceKeys(keys []string) error {
+	if len(keys) == 0 {
+		return errors.New("渠道至少需要一个密钥")
+	}
+	existingKeys, err := GetChannelKeys(channel.Id, true)
+	if err != nil {
+		return err
+	}
+	wanted := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		wanted[key] = true
+	}
+	existing := make(map[string]bool, len(existingKeys))
+	defer invalidateEnabledChannelKeys(channel.Id)
+	return DB.Transaction(func(tx *gorm.DB) error {
+		for _, key := range existingKeys {
+			existing[key.Key] = true
+			if !wanted[key.Key] {
+				if err := tx.Delete(key).Error; err != nil {
+					return err
+				}
+			}
+		}
+		for _, key := range keys {
+			if existing[key] {
+				continue
+			}
+			existing[key] = true
+			encryptedKey, err := common.EncryptSecret(key)
+			if err != nil {
+				return err
+			}
+			channelKey := &ChannelKey{
+				ChannelId:   channel.Id,
+				Key:         encryptedKey,
+				Status:      common.ChannelKeyStatusEnabled,
+				CreatedTime: common.GetTimestamp(),
+			}
+			if err := tx.Create(channelKey).Error; err != nil {
+				return err
+			}
+		}
+		// the key field of the channel keeps the first key for compatibility
+		channel.Key = keys[0]
+		encryptedKey, err := common.EncryptSecret(channel.Key)
+		if err != nil {
+			return err
+		}
+		return tx.Model(channel).Update("key", encryptedKey).Error
+	})
+}
+
+func getEnabledChannelKeys(channelId int) ([]*ChannelKey, error) {
+	enabledChannelKeysLock.RLock()
+	keys, ok := enabledChannelKeys[channelId]
+	enabledChannelKeysLock.RUnlock()
+	if ok {
+		return keys, nil
+	}
+	err := DB.Where("channel_id = ? and status = ?", channelId, common.ChannelKeyStatusEnabled).Order("id").Find(&keys).Error
+	if err != nil {
+		return nil, err
+	}
+	enabledChannelKeysLock.Lock()
+	enabledChannelKeys[channelId] = keys
+	enabledChannelKeysLock.Unlock()
+	return keys, nil
+}
+
+func invalidateEnabledChannelKeys(channelId int) {
+	enabledChannelKeysLock.Lock()
+	delete(enabledChannelKeys, channelId)
+	enabledChannelKeysLock.Unlock()
+}
+
+// SelectKey picks an enabled key of the channel according to its key rotation
+func (channel *Channel) SelectKey() (*ChannelKey, error) {
+	keys, err := getEnabledChannelKeys(channel.Id)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("渠道没有可用的密钥")
+	}
+	var key *ChannelKey
+	switch channel.KeyRotation {
+	case common.KeyRotationLeastUsed:
+		channelKeyUsesLock.Lock()
+		key = keys[0]
+		for _, k := range keys {
+			if k.UsedCount+channelKeyUses[k.Id] < key.UsedCount+channelKeyUses[key.Id] {
+				key = k
+			}
+		}
+		channelKeyUses[key.Id]++
+		channelKeyUsesLock.Unlock()
+	default:
+		channelKeyCursorsLock.Lock()
+		cursor := channelKeyCursors[channel.Id]
+		channelKeyCursors[channel.Id] = cursor + 1
+		channelKeyCursorsLock.Unlock()
+		key = keys[cursor%len(keys)]
+		channelKeyUsesLock.Lock()
+		channelKeyUses[key.Id]++
+		channelKeyUsesLock.Unlock()
+	}
+	// the cached keys are shared
+	selected := *key
+	return &selected, nil
+}
+
+// PeekKey returns the first enabled key without counting a use or moving the rotation,
+// so the channel tests don't skew the rotation or the used counts
+func (channel *Channel) PeekKey() (*ChannelKey, error) {
+	keys, err := getEnabledChannelKeys(channel.Id)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("渠道没有可用的密钥")
+	}
+	peeked := *keys[0]
+	return &peeked, nil
+}
+
+// flushChannelKeyUses adds the uses counted in memory to the used count of the keys
+func flushChannelKeyUses() {
+	channelKeyUsesLock.Lock()
+	uses := channelKeyUses
+	channelKeyUses = make(map[int]int)
+	channelKeyUsesLock.Unlock()
+	for id, count := range uses {
+		err := DB.Model(&ChannelKey{}).Where("id = ?", id).UpdateColumn("used_count", gorm.Expr("used_count + ?", count)).Error
+		if err != nil {
+			common.SysError("failed to update channel key used count: " + err.Error())
+		}
+	}
+}
+
+// SyncChannelKeys writes the used counts of the keys periodically and reloads the enabled keys after that
+func SyncChannelKeys(frequency int) {
+	for {
+		time.Sleep(time.Duration(frequency) * time.Second)
+		flushChannelKeyUses()
+		enabledChannelKeysLock.Lock()
+		enabledChannelKeys = make(map[int][]*ChannelKey)
+		enabledChannelKeysLock.Unlock()
+	}
+}
+
+func GetChannelIdByKeyId(id int) (int, error) {
+	key := &ChannelKey{}
+	err := DB.Select("id", "channel_id").First(key, "id = ?", id).Error
+	return key.ChannelId, err
+}
+
+func UpdateChannelKeyStatus(id int, status int, reason string) error {
+	key := &ChannelKey{}
+	err := DB.Select("id", "channel_id").First(key, "id = ?", id).Error
+	if err != nil {
+		return err
+	}
+	defer invalidateEnabledChannelKeys(key.ChannelId)
+	return DB.Model(&ChannelKey{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"status":        status,
+		"status_reason": reason,
+	}).Error
+}
+
+func (key *ChannelKey) UpdateBalance(balance float64) {
+	err := DB.Model(key).Select("balance_updated_time", "balance").Updates(ChannelKey{
+		BalanceUpdatedTime: common.GetTimestamp(),
+		Balance:            balance,
+	}).Error
+	if err != nil {
+		common.SysError("failed to update channel key balance: " + err.Error())
+	}
+}
+
+func DeleteChannelKeys(channelId int) error {
+	defer invalidateEnabledChannelKeys(channelId)
+	return DB.Where("channel_id = ?", channelId).Delete(&ChannelKey{}).Error
+}
+
+// migrateChannelKeys moves the key of the channels created before key pools into the pool
+func migrateChannelKeys() error {
+	var channels []*Channel
+	err := DB.Where("id not in (?)", DB.Model(&ChannelKey{}).Select("channel_id")).Find(&channels).Error
+	if err != nil {
+		return err
+	}
+	for _, channel := range channels {
+		err = channel.ReplaceKeys(SplitChannelKeys(channel.Key))
+		if err != nil {
+			common.SysError("failed to migrate keys of channel: " + err.Error())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package model
+
+import "testing"
+
+func TestPeekKeyDoesNotCountUses(t *testing.T) {
+	channel := &Channel{Name: "peeked", Key: "sk-peek-1\nsk-peek-2", Models: "gpt-3.5-turbo", Group: "default"}
+	err := channel.Insert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = channel.ReplaceKeys([]string{"sk-peek-1", "sk-peek-2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		key, err := channel.PeekKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key.Key != "sk-peek-1" {
+			t.Errorf("peeked key = %q, want the first enabled key", key.Key)
+		}
+		channelKeyUsesLock.Lock()
+		uses := channelKeyUses[key.Id]
+		channelKeyUsesLock.Unlock()
+		if uses != 0 {
+			t.Errorf("the key has %d uses after peeking, want 0", uses)
+		}
+	}
+	// the rotation starts from the first key as if it was never peeked
+	key, err := channel.SelectKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Key != "sk-peek-1" {
+		t.Errorf("selected key = %q, want the rotation unmoved", key.Key)
+	}
+}
@@ -0,0 +1,160 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"one-api/common"
+	"one-api/common/limiter"
+	"sync"
+	"time"
+)
+
+// The in-flight requests of each channel, tracked in Redis if it is enabled so that all instances share it.
+// The Redis counter expires in case some instance exits without releasing.
+
+type ChannelUtilization struct {
+	Concurrency       int `json:"concurrency"`
+	MaxConcurrency    int `json:"max_concurrency"`
+	RequestsRemaining int `json:"requests_remaining"` // -1 means unlimited
+	TokensRemaining   int `json:"tokens_remaining"`   // -1 means unlimited
+}
+
+var channelConcurrency = make(map[int]int)
+var channelConcurrencyLock sync.Mutex
+
+const channelConcurrencyExpiration = 10 * time.Minute
+
+var acquireChannelScript = redis.NewScript(`
+local current = redis.call('INCR', KEYS[1])
+redis.call('EXPIRE', KEYS[1], ARGV[2])
+if tonumber(ARGV[1]) > 0 and current > tonumber(ARGV[1]) then
+	redis.call('DECR', KEYS[1])
+	return 0
+end
+return 1
+`)
+
+var releaseChannelScript = redis.NewScript(`
+local current = redis.call('DECR', KEYS[1])
+if current < 0 then
+	redis.call('SET', KEYS[1], 0)
+end
+return 1
+`)
+
+func channelConcurrencyKey(channelId int) string {
+	return fmt.Sprintf("channelConcurrency:%d", channelId)
+}
+
+func channelRPMKey(channelId int) string {
+	return fmt.Sprintf("RPM:channel:%d", channelId)
+}
+
+// ChannelTPMKey is the limiter key used to record the tokens consumed by the channel
+func ChannelTPMKey(channelId int) string {
+	return fmt.Sprintf("TPM:channel:%d", channelId)
+}
+
+func acquireChannelConcurrency(ctx context.Context, channel *Channel) (bool, error) {
+	if common.RedisEnabled {
+		acquired, err := acquireChannelScript.Run(ctx, common.RDB, []string{channelConcurrencyKey(channel.Id)},
+			channel.MaxConcurrency, int(channelConcurrencyExpiration.Seconds())).Int()
+		return acquired == 1, err
+	}
+	channelConcurrencyLock.Lock()
+	defer channelConcurrencyLock.Unlock()
+	if channel.MaxConcurrency > 0 && channelConcurrency[channel.Id] >= channel.MaxConcurrency {
+		return false, nil
+	}
+	channelConcurrency[channel.Id]++
+	return true, nil
+}
+
+func getChannelConcurrency(ctx context.Context, channelId int) (int, error) {
+	if common.RedisEnabled {
+		concurrency, err := common.RDB.Get(ctx, channelConcurrencyKey(channelId)).Int()
+		if err == redis.Nil {
+			return 0, nil
+		}
+		return concurrency, err
+	}
+	channelConcurrencyLock.Lock()
+	defer channelConcurrencyLock.Unlock()
+	return channelConcurrency[channelId], nil
+}
+
+// TryAcquire reserves a slot of the channel, returns false if the channel is at its concurrency or rate limits.
+// Call Release after the request is finished if it returns true.
+func (channel *Channel) TryAcquire(ctx context.Context) bool {
+	rateLimiter := limiter.Default()
+	if channel.RateLimitTPM > 0 {
+		result, err := rateLimiter.Allow(ctx, ChannelTPMKey(channel.Id), channel.RateLimitTPM, time.Minute, 0)
+		if err != nil {
+			common.SysError(fmt.Sprintf("failed to check tpm limit of channel #%d: %s", channel.Id, err.Error()))
+		} else if !result.Allowed {
+			return false
+		}
+	}
+	acquired, err := acquireChannelConcurrency(ctx, channel)
+	if err != nil {
+		// don't block the traffic because of Redis
+		common.SysError(fmt.Sprintf("failed to acquire channel #%d: %s", channel.Id, err.Error()))
+		return true
+	}
+	if !acquired {
+		return false
+	}
+	if channel.RateLimitRPM > 0 {
+		result, err := rateLimiter.Allow(ctx, channelRPMKey(channel.Id), channel.RateLimitRPM, time.Minute, 1)
+		if err != nil {
+			common.SysError(fmt.Sprintf("failed to check rpm limit of channel #%d: %s", channel.Id, err.Error()))
+		} else if !result.Allowed {
+			channel.Release(ctx)
+			return false
+		}
+	}
+	return true
+}
+
+func (channel *Channel) Release(ctx context.Context) {
+	if common.RedisEnabled {
+		err := releaseChannelScript.Run(ctx, common.RDB, []string{channelConcurrencyKey(channel.Id)}).Err()
+		if err != nil {
+			common.SysError(fmt.Sprintf("failed to release channel #%d: %s", channel.Id, err.Error()))
+		}
+		return
+	}
+	channelConcurrencyLock.Lock()
+	defer channelConcurrencyLock.Unlock()
+	if channelConcurrency[channel.Id] > 0 {
+		channelConcurrency[channel.Id]--
+	}
+}
+
+func (channel *Channel) GetUtilization(ctx context.Context) *ChannelUtilization {
+	utilization := &ChannelUtilization{
+		MaxConcurrency:    channel.MaxConcurrency,
+		RequestsRemaining: -1,
+		TokensRemaining:   -1,
+	}
+	concurrency, err := getChannelConcurrency(ctx, channel.Id)
+	if err != nil {
+		common.SysError(fmt.Sprintf("failed to get concurrency of channel #%d: %s", channel.Id, err.Error()))
+	}
+	utilization.Concurrency = concurrency
+	rateLimiter := limiter.Default()
+	if channel.RateLimitRPM > 0 {
+		result, err := rateLimiter.Allow(ctx, channelRPMKey(channel.Id), channel.RateLimitRPM, time.Minute, 0)
+		if err == nil {
+			utilization.RequestsRemaining = result.Remaining
+		}
+	}
+	if channel.RateLimitTPM > 0 {
+		result, err := rateLimiter.Allow(ctx, ChannelTPMKey(channel.Id), channel.RateLimitTPM, time.Minute, 0)
+		if err == nil {
+			utilization.TokensRemaining = result.Remaining
+		}
+	}
+	return utilization
+}
@@ -0,0 +1,127 @@
+package model
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"one-api/common"
+	"sort"
+	"sync"
+)
+
+// The EWMA of the latency of each channel, observed from live traffic of this instance,
+// streams and other requests are kept apart since the time to the first token is not comparable to a full response
+type channelLatencyKey struct {
+	channelId int
+	stream    bool
+}
+
+var channelLatencyEWMA = make(map[channelLatencyKey]float64)
+var channelLatencyEWMALock sync.RWMutex
+
+const channelLatencyEWMAAlpha = 0.3
+
+// a failed request counts as a sample of this latency, so a failing channel is not preferred for being fast
+const channelLatencyFailurePenalty = 30 * 1000 // in milliseconds
+
+// the chance of trying the channels in a random order, so a channel with a stale slow EWMA is measured again
+const channelLatencyExploreRate = 0.1
+
+func UpdateChannelLatency(channelId int, stream bool, milliseconds int64) {
+	channelLatencyEWMALock.Lock()
+	defer channelLatencyEWMALock.Unlock()
+	key := channelLatencyKey{channelId: channelId, stream: stream}
+	latency, ok := channelLatencyEWMA[key]
+	if !ok {
+		channelLatencyEWMA[key] = float64(milliseconds)
+		return
+	}
+	channelLatencyEWMA[key] = channelLatencyEWMAAlpha*float64(milliseconds) + (1-channelLatencyEWMAAlpha)*latency
+}
+
+// RecordChannelLatencyFailure feeds a failed request into the EWMA as a slow one
+func RecordChannelLatencyFailure(channelId int, stream bool) {
+	UpdateChannelLatency(channelId, stream, channelLatencyFailurePenalty)
+}
+
+// GetChannelLatency returns the EWMA latency of the channel, 0 means no data yet
+func GetChannelLatency(channelId int, stream bool) float64 {
+	channelLatencyEWMALock.RLock()
+	defer channelLatencyEWMALock.RUnlock()
+	return channelLatencyEWMA[channelLatencyKey{channelId: channelId, stream: stream}]
+}
+
+// SortChannelsByStrategy orders the channels by preference, the caller should try them in order.
+// Channels with the same preference are shuffled so that the load is still spread.
+func SortChannelsByStrategy(ctx context.Context, channels []*Channel, strategy string, model string, stream bool) {
+	rand.Shuffle(len(channels), func(i, j int) {
+		channels[i], channels[j] = channels[j], channels[i]
+	})
+	switch strategy {
+	case common.RoutingStrategyWeighted:
+		// weighted random permutation, see Efraimidis & Spirakis
+		keys := make(map[int]float64, len(channels))
+		for _, channel := range channels {
+			weight := float64(channel.Weight)
+			if weight <= 0 {
+				weight = 1
+			}
+			keys[channel.Id] = math.Pow(rand.Float64(), 1/weight)
+		}
+		sort.SliceStable(channels, func(i, j int) bool {
+			return keys[channels[i].Id] > keys[channels[j].Id]
+		})
+	case common.RoutingStrategyLatency:
+		if rand.Float64() < channelLatencyExploreRate {
+			// keep the random order
+			break
+		}
+		// channels without data come first so that they get measured
+		sort.SliceStable(channels, func(i, j int) bool {
+			return GetChannelLatency(channels[i].Id, stream) < GetChannelLatency(channels[j].Id, stream)
+		})
+	case common.RoutingStrategyCost:
+		sort.SliceStable(channels, func(i, j int) bool {
+			return channels[i].GetCost(model) < channels[j].GetCost(model)
+		})
+	case common.RoutingStrategyLeastInFlight:
+		inFlight := make(map[int]int, len(channels))
+		for _, channel := range channels {
+			concurrency, err := getChannelConcurrency(ctx, channel.Id)
+			if err != nil {
+				common.SysError("failed to get channel concurrency: " + err.Error())
+			}
+			inFlight[channel.Id] = concurrency
+		}
+		sort.SliceStable(channels, func(i, j int) bool {
+			return inFlight[channels[i].Id] < inFlight[channels[j].Id]
+		})
+	}
+}
+
+// GetCost returns the relative cost of the model on this channel
+func (channel *Channel) GetCost(model string) float64 {
+	costRatio := channel.CostRatio
+	if costRatio <= 0 {
+		costRatio = 1
+	}
+	return common.GetModelRatio(model) * costRatio
+}
+
+// SortChannelsByAffinity orders the channels by rendezvous hashing of the key,
+// so the same key always prefers the same channel and only moves when that channel goes away.
+// The scores must be well mixed, with a weak hash like FNV the order would follow the channel ids instead of the key
+func SortChannelsByAffinity(channels []*Channel, key string) {
+	scores := make(map[int]uint64, len(channels))
+	for _, channel := range channels {
+		hash := sha256.New()
+		_, _ = hash.Write([]byte(key))
+		_ = binary.Write(hash, binary.BigEndian, int64(channel.Id))
+		scores[channel.Id] = binary.BigEndian.Uint64(hash.Sum(nil))
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		return scores[channels[i].Id] > scores[channels[j].Id]
+	})
+}
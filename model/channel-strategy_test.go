@@ -0,0 +1,85 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"one-api/common"
+	"testing"
+)
+
+func affinityWinners(ids []int, keys int) map[int]int {
+	wins := make(map[int]int, len(ids))
+	for i := 0; i < keys; i++ {
+		channels := make([]*Channel, 0, len(ids))
+		for _, id := range ids {
+			channels = append(channels, &Channel{Id: id})
+		}
+		SortChannelsByAffinity(channels, fmt.Sprintf("user:%d:gpt-3.5-turbo", i))
+		wins[channels[0].Id]++
+	}
+	return wins
+}
+
+func TestSortChannelsByAffinityDistribution(t *testing.T) {
+	const keys = 10000
+	for _, ids := range [][]int{{7, 12, 31, 40, 41}, {1, 2, 3}} {
+		wins := affinityWinners(ids, keys)
+		expected := keys / len(ids)
+		for _, id := range ids {
+			if wins[id] < expected*9/10 || wins[id] > expected*11/10 {
+				t.Errorf("channels %v: channel %d won %d keys, want about %d", ids, id, wins[id], expected)
+			}
+		}
+	}
+}
+
+func TestSortChannelsByAffinityIsStable(t *testing.T) {
+	ids := []int{7, 12, 31, 40, 41}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("token:%d:gpt-4", i)
+		channels := []*Channel{{Id: 7}, {Id: 12}, {Id: 31}, {Id: 40}, {Id: 41}}
+		SortChannelsByAffinity(channels, key)
+		first := channels[0].Id
+		// removing another channel doesn't move the key
+		remaining := make([]*Channel, 0, len(ids))
+		for _, id := range ids {
+			if id != first && id != ids[i%len(ids)] {
+				remaining = append(remaining, &Channel{Id: id})
+			}
+		}
+		remaining = append(remaining, &Channel{Id: first})
+		SortChannelsByAffinity(remaining, key)
+		if remaining[0].Id != first {
+			t.Fatalf("key %s moved from channel %d to %d", key, first, remaining[0].Id)
+		}
+	}
+}
+
+func TestChannelLatencyKeepsStreamsApart(t *testing.T) {
+	UpdateChannelLatency(8001, true, 300)
+	UpdateChannelLatency(8001, false, 9000)
+	if GetChannelLatency(8001, true) != 300 || GetChannelLatency(8001, false) != 9000 {
+		t.Errorf("stream = %f, non-stream = %f, want 300 and 9000", GetChannelLatency(8001, true), GetChannelLatency(8001, false))
+	}
+	RecordChannelLatencyFailure(8001, true)
+	if GetChannelLatency(8001, true) <= 300 {
+		t.Error("a failure should raise the latency")
+	}
+}
+
+func TestSortChannelsByLatencyExplores(t *testing.T) {
+	UpdateChannelLatency(8101, false, 100)
+	UpdateChannelLatency(8102, false, 5000)
+	slowFirst := 0
+	for i := 0; i < 2000; i++ {
+		channels := []*Channel{{Id: 8101}, {Id: 8102}}
+		SortChannelsByStrategy(context.Background(), channels, common.RoutingStrategyLatency, "gpt-4", false)
+		if channels[0].Id == 8102 {
+			slowFirst++
+		}
+	}
+	// about half of the explorations put the slow channel first
+	if slowFirst == 0 || slowFirst > 300 {
+		t.Errorf("the slow channel came first %d times out of 2000, want it tried now and then", slowFirst)
+	}
+}
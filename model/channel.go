@@ -5,21 +5,28 @@ import (
 )
 
 type Channel struct {
-	Id                 int     `json:"id"`
-	Type               int     `json:"type" gorm:"default:0"`
-	Key                string  `json:"key" gorm:"not null"`
-	Status             int     `json:"status" gorm:"default:1"`
-	Name               string  `json:"name" gorm:"index"`
-	Weight             int     `json:"weight"`
-	CreatedTime        int64   `json:"created_time" gorm:"bigint"`
-	TestTime           int64   `json:"test_time" gorm:"bigint"`
-	ResponseTime       int     `json:"response_time"` // in milliseconds
-	BaseURL            string  `json:"base_url" gorm:"column:base_url"`
-	Other              string  `json:"other"`
-	Balance            float64 `json:"balance"` // in USD
-	BalanceUpdatedTime int64   `json:"balance_updated_time" gorm:"bigint"`
-	Models             string  `json:"models"`
-	Group              string  `json:"group" gorm:"type:varchar(32);default:'default'"`
+	Id                 int                 `json:"id"`
+	Type               int                 `json:"type" gorm:"default:0"`
+	Key                string              `json:"key" gorm:"not null"`
+	Status             int                 `json:"status" gorm:"default:1"`
+	Name               string              `json:"name" gorm:"index"`
+	Weight             int                 `json:"weight"`
+	CreatedTime        int64               `json:"created_time" gorm:"bigint"`
+	TestTime           int64               `json:"test_time" gorm:"bigint"`
+	ResponseTime       int                 `json:"response_time"` // in milliseconds
+	BaseURL            string              `json:"base_url" gorm:"column:base_url"`
+	Other              string              `json:"other"`
+	Balance            float64             `json:"balance"` // in USD
+	BalanceUpdatedTime int64               `json:"balance_updated_time" gorm:"bigint"`
+	Models             string              `json:"models"`
+	Group              string              `json:"group" gorm:"type:varchar(32);default:'default'"`
+	MaxConcurrency     int                 `json:"max_concurrency" gorm:"default:0"` // 0 means unlimited
+	RateLimitRPM       int                 `json:"rate_limit_rpm" gorm:"default:0"`  // requests per minute, 0 means unlimited
+	RateLimitTPM       int                 `json:"rate_limit_tpm" gorm:"default:0"`  // tokens per minute, 0 means unlimited
+	CostRatio          float64             `json:"cost_ratio" gorm:"default:1"`      // price of the upstream relative to the official price
+	KeyRotation        string              `json:"key_rotation" gorm:"default:'round_robin'"`
+	Keys               []*ChannelKey       `json:"keys,omitempty" gorm:"-:all"`        // only for api response
+	Utilization        *ChannelUtilization `json:"utilization,omitempty" gorm:"-:all"` // only for api response
 }
 
 func GetAllChannels(startIdx int, num int, selectAll bool) ([]*Channel, error) {
@@ -49,35 +56,15 @@ func GetChannelById(id int, selectAll bool) (*Channel, error) {
 	return &channel, err
 }
 
-func GetRandomChannel() (*Channel, error) {
-	channel := Channel{}
-	var err error = nil
-	if common.UsingSQLite {
-		err = DB.Where("status = ? and `group` = ?", common.ChannelStatusEnabled, "default").Order("RANDOM()").Limit(1).First(&channel).Error
-	} else {
-		err = DB.Where("status = ? and `group` = ?", common.ChannelStatusEnabled, "default").Order("RAND()").Limit(1).First(&channel).Error
-	}
-	return &channel, err
-}
-
-func BatchInsertChannels(channels []Channel) error {
+func (channel *Channel) Insert() error {
 	var err error
-	err = DB.Create(&channels).Error
+	key := channel.Key
+	channel.Key, err = common.EncryptSecret(key)
 	if err != nil {
 		return err
 	}
-	for _, channel_ := range channels {
-		err = channel_.AddAbilities()
-		if err != nil {
-			return err
-		}
-	}
-	return nil
-}
-
-func (channel *Channel) Insert() error {
-	var err error
 	err = DB.Create(channel).Error
+	channel.Key = key
 	if err != nil {
 		return err
 	}
@@ -87,6 +74,10 @@ func (channel *Channel) Insert() error {
 
 func (channel *Channel) Update() error {
 	var err error
+	channel.Key, err = common.EncryptSecret(channel.Key)
+	if err != nil {
+		return err
+	}
 	err = DB.Model(channel).Updates(channel).Error
 	if err != nil {
 		return err
@@ -122,6 +113,10 @@ func (channel *Channel) Delete() error {
 	if err != nil {
 		return err
 	}
+	err = DeleteChannelKeys(channel.Id)
+	if err != nil {
+		return err
+	}
 	err = channel.DeleteAbilities()
 	return err
 }
@@ -136,3 +131,9 @@ func UpdateChannelStatusById(id int, status int) {
 		common.SysError("failed to update channel status: " + err.Error())
 	}
 }
+
+func GetChannelsByStatus(status int) ([]*Channel, error) {
+	var channels []*Channel
+	err := DB.Where("status = ?", status).Find(&channels).Error
+	return channels, err
+}
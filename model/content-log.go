@@ -0,0 +1,137 @@
+package model
+
+import (
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"one-api/common"
+	"os"
+	"strconv"
+	"time"
+)
+
+// ContentLog holds the captured request & response of a relay request, for abuse investigations only
+type ContentLog struct {
+	Id        int    `json:"id"`
+	RequestId string `json:"request_id" gorm:"type:varchar(64);index"`
+	UserId    int    `json:"user_id" gorm:"index"`
+	TokenId   int    `json:"token_id" gorm:"index"`
+	ChannelId int    `json:"channel_id"`
+	ModelName string `json:"model_name"`
+	Request   string `json:"request" gorm:"type:text"`
+	Response  string `json:"response" gorm:"type:text"`
+	Truncated bool   `json:"truncated"`
+	CreatedAt int64  `json:"created_at" gorm:"bigint;index"`
+}
+
+// ContentLogDB is the database of the content logs, set CONTENT_LOG_SQL_DSN to keep them apart from the main database
+var ContentLogDB *gorm.DB
+
+func initContentLogDB() error {
+	ContentLogDB = DB
+	if os.Getenv("CONTENT_LOG_SQL_DSN") != "" {
+		db, err := gorm.Open(mysql.Open(os.Getenv("CONTENT_LOG_SQL_DSN")), &gorm.Config{
+			PrepareStmt: true, // precompile SQL
+		})
+		if err != nil {
+			return err
+		}
+		ContentLogDB = db
+		common.SysLog("using CONTENT_LOG_SQL_DSN for content logs")
+	}
+	return ContentLogDB.AutoMigrate(&ContentLog{})
+}
+
+// ShouldLogContent returns true if content logging is enabled for the token or the group
+func ShouldLogContent(tokenContentLogging bool, group string) bool {
+	return tokenContentLogging || common.IsContentLogGroup(group)
+}
+
+// RecordContentLog redacts and truncates the content, then stores it
+func RecordContentLog(log *ContentLog) {
+	var requestTruncated, responseTruncated bool
+	log.Request, requestTruncated = common.TruncateContent(common.RedactContent(log.Request), common.ContentLogMaxSize)
+	log.Response, responseTruncated = common.TruncateContent(common.RedactContent(log.Response), common.ContentLogMaxSize)
+	log.Truncated = requestTruncated || responseTruncated
+	log.CreatedAt = common.GetTimestamp()
+	err := ContentLogDB.Create(log).Error
+	if err != nil {
+		common.SysError("failed to record content log: " + err.Error())
+	}
+}
+
+type ContentLogFilter struct {
+	UserId         int
+	TokenId        int
+	RequestId      string
+	StartTimestamp int64
+	EndTimestamp   int64
+}
+
+func GetContentLogs(filter *ContentLogFilter, startIdx int, num int) (logs []*ContentLog, err error) {
+	tx := ContentLogDB.Order("id desc")
+	if filter.UserId != 0 {
+		tx = tx.Where("user_id = ?", filter.UserId)
+	}
+	if filter.TokenId != 0 {
+		tx = tx.Where("token_id = ?", filter.TokenId)
+	}
+	if filter.RequestId != "" {
+		tx = tx.Where("request_id = ?", filter.RequestId)
+	}
+	if filter.StartTimestamp != 0 {
+		tx = tx.Where("created_at >= ?", filter.StartTimestamp)
+	}
+	if filter.EndTimestamp != 0 {
+		tx = tx.Where("created_at <= ?", filter.EndTimestamp)
+	}
+	err = tx.Limit(num).Offset(startIdx).Find(&logs).Error
+	return logs, err
+}
+
+// PurgeContentLogs deletes the content logs older than the retention days in batches, returns the number deleted
+func PurgeContentLogs() (int64, error) {
+	if common.ContentLogRetentionDays <= 0 {
+		return 0, nil
+	}
+	before := common.GetTimestamp() - int64(common.ContentLogRetentionDays)*24*60*60
+	var total int64
+	for {
+		var ids []int
+		err := ContentLogDB.Model(&ContentLog{}).Where("created_at < ?", before).Order("id").Limit(1000).Pluck("id", &ids).Error
+		if err != nil {
+			return total, err
+		}
+		if len(ids) == 0 {
+			return total, nil
+		}
+		// a list of ids may exceed the variable limit of SQLite, so the batch is deleted by its id range
+		result := ContentLogDB.Where("created_at < ? and id <= ?", before, ids[len(ids)-1]).Delete(&ContentLog{})
+		if result.Error != nil {
+			return total, result.Error
+		}
+		total += result.RowsAffected
+	}
+}
+
+func AutomaticallyPurgeContentLogs(frequency int) {
+	for {
+		time.Sleep(time.Duration(frequency) * time.Second)
+		count, err := PurgeContentLogs()
+		if err != nil {
+			common.SysError("failed to purge content logs: " + err.Error())
+			continue
+		}
+		if count != 0 {
+			common.SysLog("content logs purged: " + strconv.FormatInt(count, 10))
+		}
+	}
+}
+
+// SetTokenContentLogging enables or disables capturing the content of the token, only root can do it
+func SetTokenContentLogging(tokenId int, enabled bool) error {
+	token, err := GetTokenById(tokenId)
+	if err != nil {
+		return err
+	}
+	return DB.Model(token).Update("content_logging", enabled).Error
+}
@@ -0,0 +1,88 @@
+package model
+
+import (
+	"gorm.io/gorm"
+)
+
+const exportBatchSize = 500
+
+type ExportFilter struct {
+	Granularity    int // of the usage stats
+	UserId         int
+	TokenId        int
+	StartTimestamp int64
+	EndTimestamp   int64
+}
+
+// UsageStatExport is a row of the usage statement, the rollup of a user, token & model in a period
+type UsageStatExport struct {
+	PeriodStart      int64
+	UserId           int
+	TokenId          int
+	ModelName        string
+	Requests         int64
+	PromptTokens     int64
+	CompletionTokens int64
+	Quota            int64
+}
+
+// ExportConsumeLogs calls fn with the consume logs in the range in batches, so they are never loaded at once
+func ExportConsumeLogs(filter *ExportFilter, fn func(logs []*Log) error) error {
+	tx := DB.Where("type = ? and created_at >= ? and created_at <= ?", LogTypeConsume, filter.StartTimestamp, filter.EndTimestamp)
+	if filter.UserId != 0 {
+		tx = tx.Where("user_id = ?", filter.UserId)
+	}
+	if filter.TokenId != 0 {
+		tx = tx.Where("token_id = ?", filter.TokenId)
+	}
+	var logs []*Log
+	var fnErr error
+	err := tx.FindInBatches(&logs, exportBatchSize, func(_ *gorm.DB, _ int) error {
+		fnErr = fn(logs)
+		return fnErr
+	}).Error
+	if fnErr != nil {
+		return fnErr
+	}
+	return err
+}
+
+// ExportUsageStats calls fn with the usage of each user, token & model in each period of the range in batches,
+// ordered by the period, each batch starts after the last row of the previous one, so the cursor is not kept open
+// while fn writes to a slow client and the later batches are not slower than the first ones
+func ExportUsageStats(filter *ExportFilter, fn func(stats []*UsageStatExport) error) error {
+	var last *UsageStatExport
+	for {
+		tx := DB.Model(&UsageStat{}).
+			Select("period_start, user_id, token_id, model_name, "+usageStatSums).
+			Where("granularity = ? and period_start >= ? and period_start <= ?", filter.Granularity, filter.StartTimestamp, filter.EndTimestamp)
+		if filter.UserId != 0 {
+			tx = tx.Where("user_id = ?", filter.UserId)
+		}
+		if filter.TokenId != 0 {
+			tx = tx.Where("token_id = ?", filter.TokenId)
+		}
+		if last != nil {
+			// (period_start, user_id, token_id, model_name) > last, spelled out for the databases without row values
+			tx = tx.Where("(period_start > ? or (period_start = ? and (user_id > ? or (user_id = ? and (token_id > ? or (token_id = ? and model_name > ?))))))",
+				last.PeriodStart, last.PeriodStart, last.UserId, last.UserId, last.TokenId, last.TokenId, last.ModelName)
+		}
+		var stats []*UsageStatExport
+		err := tx.Group("period_start, user_id, token_id, model_name").Order("period_start, user_id, token_id, model_name").
+			Limit(exportBatchSize).Scan(&stats).Error
+		if err != nil {
+			return err
+		}
+		if len(stats) == 0 {
+			return nil
+		}
+		err = fn(stats)
+		if err != nil {
+			return err
+		}
+		if len(stats) < exportBatchSize {
+			return nil
+		}
+		last = stats[len(stats)-1]
+	}
+}
@@ -0,0 +1,242 @@
+package model
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"gorm.io/gorm"
+	"one-api/common"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const logPurgeBatchSize = 1000
+
+var logTypeNames = map[int]string{
+	LogTypeTopup:   "topup",
+	LogTypeConsume: "consume",
+	LogTypeManage:  "manage",
+	LogTypeSystem:  "system",
+}
+
+// only one purge runs at a time, so the same rows are never archived twice
+var logPurgeLock sync.Mutex
+
+// logArchive appends the deleted rows to a gzipped JSONL file, the file is created on the first write
+type logArchive struct {
+	name    string
+	file    *os.File
+	gz      *gzip.Writer
+	encoder *json.Encoder
+}
+
+func newLogArchive(name string) *logArchive {
+	if common.LogArchiveDir == "" {
+		return nil
+	}
+	return &logArchive{name: name}
+}
+
+func (archive *logArchive) open() error {
+	err := os.MkdirAll(common.LogArchiveDir, 0755)
+	if err != nil {
+		return err
+	}
+	// gzip members can be concatenated, so appending to the archive of the same day is fine
+	path := filepath.Join(common.LogArchiveDir, fmt.Sprintf("%s-%s.jsonl.gz", archive.name, time.Now().Format("20060102")))
+	archive.file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	archive.gz = gzip.NewWriter(archive.file)
+	archive.encoder = json.NewEncoder(archive.gz)
+	return nil
+}
+
+// write archives the rows and flushes them to the disk, they must be written before they are deleted
+func (archive *logArchive) write(rows []any) error {
+	if archive == nil {
+		return nil
+	}
+	if archive.file == nil {
+		err := archive.open()
+		if err != nil {
+			return err
+		}
+	}
+	for _, row := range rows {
+		err := archive.encoder.Encode(row)
+		if err != nil {
+			return err
+		}
+	}
+	err := archive.gz.Flush()
+	if err != nil {
+		return err
+	}
+	return archive.file.Sync()
+}
+
+func (archive *logArchive) close() {
+	if archive == nil || archive.file == nil {
+		return
+	}
+	err := archive.gz.Close()
+	if err != nil {
+		common.SysError("failed to close log archive: " + err.Error())
+	}
+	_ = archive.file.Close()
+}
+
+// purgeLogsBefore deletes the logs of the type created before the timestamp in batches, 0 means all the types
+func purgeLogsBefore(logType int, before int64, archive *logArchive) (int64, error) {
+	query := func() *gorm.DB {
+		tx := DB.Where("created_at < ?", before)
+		if logType != LogTypeUnknown {
+			tx = tx.Where("type = ?", logType)
+		}
+		return tx
+	}
+	var total int64
+	for {
+		var logs []*Log
+		err := query().Order("id").Limit(logPurgeBatchSize).Find(&logs).Error
+		if err != nil || len(logs) == 0 {
+			return total, err
+		}
+		rows := make([]any, len(logs))
+		for i, log := range logs {
+			rows[i] = log
+		}
+		err = archive.write(rows)
+		if err != nil {
+			return total, err
+		}
+		// a list of ids may exceed the variable limit of SQLite, so the batch is deleted by its id range
+		result := query().Where("id <= ?", logs[len(logs)-1].Id).Delete(&Log{})
+		if result.Error != nil {
+			return total, result.Error
+		}
+		total += result.RowsAffected
+	}
+}
+
+// purgeRows deletes the rows of the table of T matching the query in batches, id returns the id of a row
+func purgeRows[T any](query func() *gorm.DB, archive *logArchive, id func(row *T) int) (int64, error) {
+	var total int64
+	for {
+		var rows []*T
+		err := query().Order("id").Limit(logPurgeBatchSize).Find(&rows).Error
+		if err != nil || len(rows) == 0 {
+			return total, err
+		}
+		archived := make([]any, len(rows))
+		for i, row := range rows {
+			archived[i] = row
+		}
+		err = archive.write(archived)
+		if err != nil {
+			return total, err
+		}
+		result := query().Where("id <= ?", id(rows[len(rows)-1])).Delete(new(T))
+		if result.Error != nil {
+			return total, result.Error
+		}
+		total += result.RowsAffected
+	}
+}
+
+// DeleteLogsBefore deletes the logs of the type created before the timestamp, 0 means all the types,
+// the deleted logs are archived first if LOG_ARCHIVE_DIR is set
+func DeleteLogsBefore(logType int, before int64) (int64, error) {
+	name := "logs"
+	if logType != LogTypeUnknown {
+		typeName, ok := logTypeNames[logType]
+		if !ok {
+			return 0, fmt.Errorf("unknown log type: %d", logType)
+		}
+		name = "logs-" + typeName
+	}
+	logPurgeLock.Lock()
+	defer logPurgeLock.Unlock()
+	archive := newLogArchive(name)
+	defer archive.close()
+	return purgeLogsBefore(logType, before, archive)
+}
+
+// CleanExpiredLogs enforces LogRetentionDays, returns the number of deleted logs by type
+func CleanExpiredLogs() (map[string]int64, error) {
+	logPurgeLock.Lock()
+	defer logPurgeLock.Unlock()
+	now := common.GetTimestamp()
+	counts := make(map[string]int64)
+	for logType, typeName := range logTypeNames {
+		days := common.GetLogRetentionDays(typeName)
+		if days <= 0 {
+			continue
+		}
+		archive := newLogArchive("logs-" + typeName)
+		count, err := purgeLogsBefore(logType, now-int64(days)*24*60*60, archive)
+		archive.close()
+		counts[typeName] = count
+		if err != nil {
+			return counts, err
+		}
+	}
+	if days := common.GetLogRetentionDays("audit"); days > 0 {
+		before := now - int64(days)*24*60*60
+		archive := newLogArchive("audit")
+		count, err := purgeRows(func() *gorm.DB {
+			return DB.Where("created_at < ?", before)
+		}, archive, func(log *AuditLog) int { return log.Id })
+		archive.close()
+		counts["audit"] = count
+		if err != nil {
+			return counts, err
+		}
+	}
+	if days := common.GetLogRetentionDays("channel_health"); days > 0 {
+		before := now - int64(days)*24*60*60
+		archive := newLogArchive("channel-health")
+		count, err := purgeRows(func() *gorm.DB {
+			return DB.Where("created_at < ?", before)
+		}, archive, func(health *ChannelHealth) int { return health.Id })
+		archive.close()
+		counts["channel_health"] = count
+		if err != nil {
+			return counts, err
+		}
+	}
+	if days := common.GetLogRetentionDays("webhook_deliveries"); days > 0 {
+		before := now - int64(days)*24*60*60
+		archive := newLogArchive("webhook-deliveries")
+		// the pending deliveries are still retried
+		count, err := purgeRows(func() *gorm.DB {
+			return DB.Where("created_time < ? and status <> ?", before, WebhookDeliveryStatusPending)
+		}, archive, func(delivery *WebhookDelivery) int { return delivery.Id })
+		archive.close()
+		counts["webhook_deliveries"] = count
+		if err != nil {
+			return counts, err
+		}
+	}
+	return counts, nil
+}
+
+func AutomaticallyCleanExpiredLogs(frequency int) {
+	for {
+		time.Sleep(time.Duration(frequency) * time.Second)
+		counts, err := CleanExpiredLogs()
+		if err != nil {
+			common.SysError("failed to clean expired logs: " + err.Error())
+		}
+		for typeName, count := range counts {
+			if count != 0 {
+				common.SysLog(typeName + " logs cleaned: " + strconv.FormatInt(count, 10))
+			}
+		}
+	}
+}
@@ -3,13 +3,28 @@ package model
 import "one-api/common"
 
 type Log struct {
-	Id        int    `json:"id"`
-	UserId    int    `json:"user_id" gorm:"index"`
-	CreatedAt int64  `json:"created_at" gorm:"bigint"`
-	Type      int    `json:"type" gorm:"index"`
-	Content   string `json:"content"`
+	Id               int    `json:"id"`
+	UserId           int    `json:"user_id" gorm:"index"`
+	CreatedAt        int64  `json:"created_at" gorm:"bigint;index"`
+	Type             int    `json:"type" gorm:"index"`
+	Content          string `json:"content"`
+	TokenId          int    `json:"token_id" gorm:"default:0;index"`
+	ModelName        string `json:"model_name" gorm:"index;default:''"`
+	ChannelId        int    `json:"channel_id" gorm:"default:0;index"`
+	PromptTokens     int    `json:"prompt_tokens" gorm:"default:0"`
+	CompletionTokens int    `json:"completion_tokens" gorm:"default:0"`
+	Quota            int    `json:"quota" gorm:"default:0"`
+	RoutingStrategy  string `json:"routing_strategy" gorm:"default:''"`
 }
 
+const (
+	LogTypeUnknown = iota
+	LogTypeTopup
+	LogTypeConsume
+	LogTypeManage
+	LogTypeSystem
+)
+
 func RecordLog(userId int, logType int, content string) {
 	log := &Log{
 		UserId:    userId,
@@ -23,6 +38,17 @@ func RecordLog(userId int, logType int, content string) {
 	}
 }
 
+func RecordConsumeLog(log *Log) {
+	log.CreatedAt = common.GetTimestamp()
+	log.Type = LogTypeConsume
+	err := DB.Create(log).Error
+	if err != nil {
+		common.SysError("failed to record consume log: " + err.Error())
+		return
+	}
+	updateUsageStats(log)
+}
+
 func GetAllLogs(logType int, startIdx int, num int) (logs []*Log, err error) {
 	err = DB.Where("type = ?", logType).Order("id desc").Limit(num).Offset(startIdx).Find(&logs).Error
 	return logs, err
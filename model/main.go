@@ -25,7 +25,7 @@ func createRootAccountIfNeed() error {
 			Role:        common.RoleRootUser,
 			Status:      common.UserStatusEnabled,
 			DisplayName: "Root User",
-			AccessToken: common.GetUUID(),
+			AccessToken: common.EncryptSecretDeterministic(common.GetUUID()),
 			Quota:       100000000,
 		}
 		DB.Create(&rootUser)
@@ -55,7 +55,11 @@ func InitDB() (err error) {
 	}
 	if err == nil {
 		DB = db
-		err := db.AutoMigrate(&Channel{})
+		err := registerDBMetrics(db)
+		if err != nil {
+			return err
+		}
+		err = db.AutoMigrate(&Channel{})
 		if err != nil {
 			return err
 		}
@@ -79,6 +83,62 @@ func InitDB() (err error) {
 		if err != nil {
 			return err
 		}
+		err = db.AutoMigrate(&ChannelHealth{})
+		if err != nil {
+			return err
+		}
+		err = db.AutoMigrate(&Log{})
+		if err != nil {
+			return err
+		}
+		err = db.AutoMigrate(&ChannelKey{})
+		if err != nil {
+			return err
+		}
+		err = db.AutoMigrate(&UserBudget{})
+		if err != nil {
+			return err
+		}
+		err = db.AutoMigrate(&WebhookSubscription{})
+		if err != nil {
+			return err
+		}
+		err = db.AutoMigrate(&WebhookDelivery{})
+		if err != nil {
+			return err
+		}
+		err = db.AutoMigrate(&AuditLog{})
+		if err != nil {
+			return err
+		}
+		err = db.AutoMigrate(&UsageStat{})
+		if err != nil {
+			return err
+		}
+		err = backfillUsageStats()
+		if err != nil {
+			return err
+		}
+		err = initContentLogDB()
+		if err != nil {
+			return err
+		}
+		err = InitSecretEncryption()
+		if err != nil {
+			return err
+		}
+		err = initTokenKeySalt()
+		if err != nil {
+			return err
+		}
+		err = migrateTokenKeys()
+		if err != nil {
+			return err
+		}
+		err = migrateChannelKeys()
+		if err != nil {
+			return err
+		}
 		err = createRootAccountIfNeed()
 		return err
 	} else {
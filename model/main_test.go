@@ -0,0 +1,33 @@
+package model
+
+import (
+	"fmt"
+	"one-api/common"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testMasterKey = "test-master-key"
+
+// TestMain runs the tests against a fresh SQLite database with the secrets encrypted
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "one-api-model-test")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	_ = os.Unsetenv("SQL_DSN")
+	_ = os.Unsetenv("CONTENT_LOG_SQL_DSN")
+	_ = os.Setenv("MASTER_KEY", testMasterKey)
+	common.SQLitePath = filepath.Join(dir, "one-api.db")
+	err = InitDB()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	_ = CloseDB()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
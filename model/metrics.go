@@ -0,0 +1,84 @@
+package model
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"gorm.io/gorm"
+	"one-api/common"
+	"one-api/common/metrics"
+	"strconv"
+	"time"
+)
+
+const metricsStartTimeKey = "metrics:start_time"
+
+// registerDBMetrics observes the latency of every query with gorm callbacks
+func registerDBMetrics(db *gorm.DB) error {
+	before := func(tx *gorm.DB) {
+		tx.InstanceSet(metricsStartTimeKey, time.Now())
+	}
+	after := func(operation string) func(tx *gorm.DB) {
+		return func(tx *gorm.DB) {
+			start, ok := tx.InstanceGet(metricsStartTimeKey)
+			if !ok {
+				return
+			}
+			metrics.DBQueryDuration.WithLabelValues(operation).Observe(time.Since(start.(time.Time)).Seconds())
+		}
+	}
+	callback := db.Callback()
+	for _, err := range []error{
+		callback.Create().Before("gorm:create").Register("metrics:before_create", before),
+		callback.Create().After("gorm:create").Register("metrics:after_create", after("create")),
+		callback.Query().Before("gorm:query").Register("metrics:before_query", before),
+		callback.Query().After("gorm:query").Register("metrics:after_query", after("query")),
+		callback.Update().Before("gorm:update").Register("metrics:before_update", before),
+		callback.Update().After("gorm:update").Register("metrics:after_update", after("update")),
+		callback.Delete().Before("gorm:delete").Register("metrics:before_delete", before),
+		callback.Delete().After("gorm:delete").Register("metrics:after_delete", after("delete")),
+		callback.Row().Before("gorm:row").Register("metrics:before_row", before),
+		callback.Row().After("gorm:row").Register("metrics:after_row", after("row")),
+		callback.Raw().Before("gorm:raw").Register("metrics:before_raw", before),
+		callback.Raw().After("gorm:raw").Register("metrics:after_raw", after("raw")),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// channelStatusCollector reports whether each channel is enabled, read from the database on every scrape
+type channelStatusCollector struct {
+	enabled *prometheus.Desc
+}
+
+func (collector *channelStatusCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- collector.enabled
+}
+
+func (collector *channelStatusCollector) Collect(ch chan<- prometheus.Metric) {
+	if DB == nil {
+		return
+	}
+	var channels []*Channel
+	err := DB.Select("id", "name", "status").Find(&channels).Error
+	if err != nil {
+		common.SysError("failed to collect channel status: " + err.Error())
+		return
+	}
+	for _, channel := range channels {
+		enabled := 0.0
+		if channel.Status == common.ChannelStatusEnabled {
+			enabled = 1
+		}
+		ch <- prometheus.MustNewConstMetric(collector.enabled, prometheus.GaugeValue, enabled,
+			strconv.Itoa(channel.Id), channel.Name, strconv.Itoa(channel.Status))
+	}
+}
+
+func init() {
+	metrics.Registry.MustRegister(&channelStatusCollector{
+		enabled: prometheus.NewDesc("one_api_channel_enabled", "Whether the channel is enabled (1) or disabled (0).",
+			[]string{"channel", "name", "status"}, nil),
+	})
+}
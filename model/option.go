@@ -1,7 +1,9 @@
 package model
 
 import (
+	"gorm.io/gorm/clause"
 	"one-api/common"
+	"one-api/common/notify"
 	"strconv"
 	"strings"
 	"time"
@@ -12,6 +14,34 @@ type Option struct {
 	Value string `json:"value"`
 }
 
+// initGeneratedOption returns the value of a hidden option and generates it on the first run,
+// the value is only written while it's still empty so the instances starting together end up with the same one
+func initGeneratedOption(key string, generate func() (string, error)) (value string, generated bool, err error) {
+	err = DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&Option{Key: key}).Error
+	if err != nil {
+		return "", false, err
+	}
+	var option Option
+	err = DB.Where(&Option{Key: key}).First(&option).Error
+	if err != nil || option.Value != "" {
+		return option.Value, false, err
+	}
+	value, err = generate()
+	if err != nil {
+		return "", false, err
+	}
+	result := DB.Model(&Option{}).Where(map[string]interface{}{"key": key, "value": ""}).Update("value", value)
+	if result.Error != nil {
+		return "", false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		// generated by another instance in the meantime
+		err = DB.Where(&Option{Key: key}).First(&option).Error
+		return option.Value, false, err
+	}
+	return value, true, nil
+}
+
 func AllOption() ([]*Option, error) {
 	var options []*Option
 	var err error
@@ -35,6 +65,11 @@ func InitOptionMap() {
 	common.OptionMap["RegisterEnabled"] = strconv.FormatBool(common.RegisterEnabled)
 	common.OptionMap["AutomaticDisableChannelEnabled"] = strconv.FormatBool(common.AutomaticDisableChannelEnabled)
 	common.OptionMap["ChannelDisableThreshold"] = strconv.FormatFloat(common.ChannelDisableThreshold, 'f', -1, 64)
+	common.OptionMap["ChannelBreakerFailureThreshold"] = strconv.Itoa(common.ChannelBreakerFailureThreshold)
+	common.OptionMap["ChannelBreakerWindow"] = strconv.Itoa(common.ChannelBreakerWindow)
+	common.OptionMap["ChannelBreakerCooldown"] = strconv.Itoa(common.ChannelBreakerCooldown)
+	common.OptionMap["ChannelTestConcurrency"] = strconv.Itoa(common.ChannelTestConcurrency)
+	common.OptionMap["RelayLatencySampleRate"] = strconv.FormatFloat(common.RelayLatencySampleRate, 'f', -1, 64)
 	common.OptionMap["SMTPServer"] = ""
 	common.OptionMap["SMTPFrom"] = ""
 	common.OptionMap["SMTPPort"] = strconv.Itoa(common.SMTPPort)
@@ -54,10 +89,21 @@ func InitOptionMap() {
 	common.OptionMap["WeChatAccountQRCodeImageURL"] = ""
 	common.OptionMap["TurnstileSiteKey"] = ""
 	common.OptionMap["TurnstileSecretKey"] = ""
+	common.OptionMap["MetricsToken"] = ""
 	common.OptionMap["QuotaForNewUser"] = strconv.Itoa(common.QuotaForNewUser)
 	common.OptionMap["QuotaRemindThreshold"] = strconv.Itoa(common.QuotaRemindThreshold)
 	common.OptionMap["PreConsumedQuota"] = strconv.Itoa(common.PreConsumedQuota)
+	common.OptionMap["QuotaPerUnit"] = strconv.FormatFloat(common.QuotaPerUnit, 'f', -1, 64)
 	common.OptionMap["ModelRatio"] = common.ModelRatio2JSONString()
+	common.OptionMap["GroupRateLimit"] = common.GroupRateLimit2JSONString()
+	common.OptionMap["GroupRoutingStrategy"] = common.GroupRoutingStrategy2JSONString()
+	common.OptionMap["ChannelAffinityMode"] = common.ChannelAffinityMode
+	common.OptionMap["NotificationSinks"] = notify.Sinks2JSONString()
+	common.OptionMap["ContentLogGroups"] = common.ContentLogGroups
+	common.OptionMap["ContentLogMaxSize"] = strconv.Itoa(common.ContentLogMaxSize)
+	common.OptionMap["ContentLogRetentionDays"] = strconv.Itoa(common.ContentLogRetentionDays)
+	common.OptionMap["ContentLogRedactPatterns"] = common.ContentLogRedactPatterns2JSONString()
+	common.OptionMap["LogRetentionDays"] = common.LogRetentionDays2JSONString()
 	common.OptionMap["TopUpLink"] = common.TopUpLink
 	common.OptionMapRWMutex.Unlock()
 	loadOptionsFromDatabase()
@@ -66,6 +112,16 @@ func InitOptionMap() {
 func loadOptionsFromDatabase() {
 	options, _ := AllOption()
 	for _, option := range options {
+		if option.Key == wrappedDataKeyOption || option.Key == tokenKeySaltOption || option.Key == usageStatsBackfilledOption {
+			continue
+		}
+		if secretOptions[option.Key] {
+			err := decryptSecretField(&option.Value)
+			if err != nil {
+				common.SysError("Failed to load option " + option.Key + ": " + err.Error())
+				continue
+			}
+		}
 		err := updateOptionMap(option.Key, option.Value)
 		if err != nil {
 			common.SysError("Failed to update option map: " + err.Error())
@@ -89,6 +145,13 @@ func UpdateOption(key string, value string) error {
 	// https://gorm.io/docs/update.html#Save-All-Fields
 	DB.FirstOrCreate(&option, Option{Key: key})
 	option.Value = value
+	if secretOptions[key] {
+		var err error
+		option.Value, err = common.EncryptSecret(value)
+		if err != nil {
+			return err
+		}
+	}
 	// Save is a combination function.
 	// If save value does not contain primary key, it will execute Create,
 	// otherwise it will execute Update (with all fields).
@@ -147,6 +210,8 @@ func updateOptionMap(key string, value string) (err error) {
 		common.SMTPFrom = value
 	case "SMTPToken":
 		common.SMTPToken = value
+	case "MetricsToken":
+		common.MetricsToken = value
 	case "ServerAddress":
 		common.ServerAddress = value
 	case "GitHubClientId":
@@ -177,10 +242,52 @@ func updateOptionMap(key string, value string) (err error) {
 		common.PreConsumedQuota, _ = strconv.Atoi(value)
 	case "ModelRatio":
 		err = common.UpdateModelRatioByJSONString(value)
+	case "GroupRateLimit":
+		err = common.UpdateGroupRateLimitByJSONString(value)
+	case "GroupRoutingStrategy":
+		err = common.UpdateGroupRoutingStrategyByJSONString(value)
+	case "ChannelAffinityMode":
+		common.ChannelAffinityMode = value
+	case "NotificationSinks":
+		err = notify.UpdateSinksByJSONString(value)
+	case "ContentLogGroups":
+		common.ContentLogGroups = value
+	case "ContentLogMaxSize":
+		// a broken value would truncate every content log to nothing
+		maxSize, parseErr := strconv.Atoi(value)
+		if parseErr != nil || maxSize <= 0 {
+			maxSize = common.DefaultContentLogMaxSize
+		}
+		common.ContentLogMaxSize = maxSize
+	case "ContentLogRetentionDays":
+		common.ContentLogRetentionDays, _ = strconv.Atoi(value)
+	case "ContentLogRedactPatterns":
+		err = common.UpdateContentLogRedactPatternsByJSONString(value)
+	case "LogRetentionDays":
+		err = common.UpdateLogRetentionDaysByJSONString(value)
 	case "TopUpLink":
 		common.TopUpLink = value
 	case "ChannelDisableThreshold":
 		common.ChannelDisableThreshold, _ = strconv.ParseFloat(value, 64)
+	case "ChannelBreakerFailureThreshold":
+		common.ChannelBreakerFailureThreshold, _ = strconv.Atoi(value)
+	case "ChannelBreakerWindow":
+		common.ChannelBreakerWindow, _ = strconv.Atoi(value)
+	case "ChannelBreakerCooldown":
+		common.ChannelBreakerCooldown, _ = strconv.Atoi(value)
+	case "ChannelTestConcurrency":
+		common.ChannelTestConcurrency, _ = strconv.Atoi(value)
+	case "RelayLatencySampleRate":
+		common.RelayLatencySampleRate, _ = strconv.ParseFloat(value, 64)
+	case "QuotaPerUnit":
+		// the quota is divided by it, a broken value keeps the previous one
+		quotaPerUnit, parseErr := strconv.ParseFloat(value, 64)
+		if parseErr != nil || quotaPerUnit <= 0 {
+			common.SysError("invalid QuotaPerUnit: " + value)
+			common.OptionMap[key] = strconv.FormatFloat(common.QuotaPerUnit, 'f', -1, 64)
+			break
+		}
+		common.QuotaPerUnit = quotaPerUnit
 	}
 	return err
 }
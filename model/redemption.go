@@ -54,18 +54,33 @@ func Redeem(key string, userId int) (quota int, err error) {
 	if redemption.Status != common.RedemptionCodeStatusEnabled {
 		return 0, errors.New("该兑换码已被使用")
 	}
+	// the code is marked as used before the quota is added, so concurrent requests can't redeem it twice
+	result := DB.Model(&Redemption{}).Where("id = ? and status = ?", redemption.Id, common.RedemptionCodeStatusEnabled).Updates(map[string]interface{}{
+		"status":        common.RedemptionCodeStatusUsed,
+		"redeemed_time": common.GetTimestamp(),
+	})
+	if result.Error != nil {
+		return 0, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return 0, errors.New("该兑换码已被使用")
+	}
 	err = IncreaseUserQuota(userId, redemption.Quota)
 	if err != nil {
+		rollbackErr := DB.Model(&Redemption{}).Where("id = ?", redemption.Id).Updates(map[string]interface{}{
+			"status":        common.RedemptionCodeStatusEnabled,
+			"redeemed_time": 0,
+		}).Error
+		if rollbackErr != nil {
+			common.SysError("更新兑换码状态失败：" + rollbackErr.Error())
+		}
 		return 0, err
 	}
-	go func() {
-		redemption.RedeemedTime = common.GetTimestamp()
-		redemption.Status = common.RedemptionCodeStatusUsed
-		err := redemption.SelectUpdate()
-		if err != nil {
-			common.SysError("更新兑换码状态失败：" + err.Error())
-		}
-	}()
+	EmitWebhookEvent(WebhookEventUserTopup, map[string]any{
+		"user_id":       userId,
+		"quota":         redemption.Quota,
+		"redemption_id": redemption.Id,
+	})
 	return redemption.Quota, nil
 }
 
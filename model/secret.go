@@ -0,0 +1,187 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"one-api/common"
+)
+
+// The data key wrapped by the master key, never loaded into the option map
+const wrappedDataKeyOption = "WrappedDataKey"
+
+// The options which are encrypted at rest
+var secretOptions = map[string]bool{
+	"SMTPToken":          true,
+	"GitHubClientSecret": true,
+	"WeChatServerToken":  true,
+	"TurnstileSecretKey": true,
+	"MetricsToken":       true,
+	"NotificationSinks":  true,
+}
+
+// decryptSecretField returns an error instead of blanking the field, a blank secret would be written back on the next save
+func decryptSecretField(field *string) error {
+	value, err := common.DecryptSecret(*field)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt secret: %w", err)
+	}
+	*field = value
+	return nil
+}
+
+func (channel *Channel) AfterFind(tx *gorm.DB) error {
+	return decryptSecretField(&channel.Key)
+}
+
+func (key *ChannelKey) AfterFind(tx *gorm.DB) error {
+	return decryptSecretField(&key.Key)
+}
+
+func (user *User) AfterFind(tx *gorm.DB) error {
+	return decryptSecretField(&user.AccessToken)
+}
+
+func (subscription *WebhookSubscription) AfterFind(tx *gorm.DB) error {
+	return decryptSecretField(&subscription.Secret)
+}
+
+// InitSecretEncryption loads the data key if MASTER_KEY is set,
+// a new data key is generated on the first run, then plaintext secrets are encrypted.
+// It fails if the secrets are encrypted but the master key is missing or wrong, they can't be read without it
+func InitSecretEncryption() error {
+	masterKey, err := common.GetMasterKey()
+	if err != nil {
+		return err
+	}
+	if masterKey == nil {
+		var option Option
+		if DB.Where(&Option{Key: wrappedDataKeyOption}).Limit(1).Find(&option).RowsAffected != 0 && option.Value != "" {
+			return errors.New("the secrets are encrypted but MASTER_KEY or MASTER_KEY_FILE is not set")
+		}
+		return nil
+	}
+	wrappedDataKey, generated, err := initGeneratedOption(wrappedDataKeyOption, func() (string, error) {
+		dataKey, err := common.GenerateDataKey()
+		if err != nil {
+			return "", err
+		}
+		return common.WrapDataKey(masterKey, dataKey)
+	})
+	if err != nil {
+		return err
+	}
+	if generated {
+		common.SysLog("data key generated")
+	}
+	dataKey, err := common.UnwrapDataKey(masterKey, wrappedDataKey)
+	if err != nil {
+		return fmt.Errorf("failed to unwrap the data key, the master key is wrong: %w", err)
+	}
+	err = common.SetDataKey(dataKey)
+	if err != nil {
+		return err
+	}
+	return migrateSecrets()
+}
+
+func encryptColumn(model interface{}, column string, deterministic bool) error {
+	var rows []map[string]interface{}
+	err := DB.Model(model).Select("id", column).Find(&rows).Error
+	if err != nil {
+		return err
+	}
+	count := 0
+	for _, row := range rows {
+		var value string
+		switch v := row[column].(type) {
+		case string:
+			value = v
+		case []byte:
+			value = string(v)
+		}
+		if value == "" || common.IsEncryptedSecret(value) {
+			continue
+		}
+		if deterministic {
+			value = common.EncryptSecretDeterministic(value)
+		} else {
+			value, err = common.EncryptSecret(value)
+			if err != nil {
+				return err
+			}
+		}
+		err = DB.Model(model).Where("id = ?", row["id"]).UpdateColumn(column, value).Error
+		if err != nil {
+			return err
+		}
+		count++
+	}
+	if count != 0 {
+		common.SysLog(fmt.Sprintf("%d secrets encrypted: %s", count, column))
+	}
+	return nil
+}
+
+// migrateSecrets encrypts the plaintext secrets stored before the encryption was enabled
+func migrateSecrets() error {
+	err := encryptColumn(&Channel{}, "key", false)
+	if err != nil {
+		return err
+	}
+	err = encryptColumn(&ChannelKey{}, "key", false)
+	if err != nil {
+		return err
+	}
+	err = encryptColumn(&User{}, "access_token", true)
+	if err != nil {
+		return err
+	}
+	err = encryptColumn(&WebhookSubscription{}, "secret", false)
+	if err != nil {
+		return err
+	}
+	for key := range secretOptions {
+		var option Option
+		if DB.Where(&Option{Key: key}).Limit(1).Find(&option).RowsAffected == 0 || common.IsEncryptedSecret(option.Value) {
+			continue
+		}
+		option.Value, err = common.EncryptSecret(option.Value)
+		if err != nil {
+			return err
+		}
+		err = DB.Save(&option).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RotateMasterKey re-wraps the data key with NEW_MASTER_KEY, the secrets themselves are untouched
+func RotateMasterKey() error {
+	masterKey, err := common.GetMasterKey()
+	if err != nil {
+		return err
+	}
+	newMasterKey, err := common.GetNewMasterKey()
+	if err != nil {
+		return err
+	}
+	if masterKey == nil || newMasterKey == nil {
+		return errors.New("both MASTER_KEY and NEW_MASTER_KEY should be set")
+	}
+	var option Option
+	if DB.Where(&Option{Key: wrappedDataKeyOption}).Limit(1).Find(&option).RowsAffected == 0 {
+		return errors.New("no data key found, start the server with MASTER_KEY first")
+	}
+	dataKey, err := common.UnwrapDataKey(masterKey, option.Value)
+	if err != nil {
+		return err
+	}
+	option.Value, err = common.WrapDataKey(newMasterKey, dataKey)
+	if err != nil {
+		return err
+	}
+	return DB.Save(&option).Error
+}
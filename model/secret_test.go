@@ -0,0 +1,130 @@
+package model
+
+import (
+	"one-api/common"
+	"testing"
+)
+
+func TestChannelKeysEncryptedAtRest(t *testing.T) {
+	channel := &Channel{Name: "encrypted", Key: "sk-encrypted-1", Models: "gpt-3.5-turbo", Group: "default"}
+	err := channel.Insert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = channel.ReplaceKeys([]string{"sk-encrypted-1", "sk-encrypted-2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored []string
+	err = DB.Model(&ChannelKey{}).Where("channel_id = ?", channel.Id).Order("id").Pluck("key", &stored).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range stored {
+		if !common.IsEncryptedSecret(key) {
+			t.Errorf("the key is stored in plaintext: %s", key)
+		}
+	}
+	keys, err := GetChannelKeys(channel.Id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].Key != "sk-encrypted-1" || keys[1].Key != "sk-encrypted-2" {
+		t.Errorf("the keys are not decrypted on read: %+v", keys)
+	}
+}
+
+func TestRotateMasterKey(t *testing.T) {
+	channel := &Channel{Name: "rotated", Key: "sk-rotated", Models: "gpt-3.5-turbo", Group: "default"}
+	err := channel.Insert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("NEW_MASTER_KEY", "rotated-master-key")
+	err = RotateMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		// wrap the data key with the master key of the other tests again
+		t.Setenv("MASTER_KEY", "rotated-master-key")
+		t.Setenv("NEW_MASTER_KEY", testMasterKey)
+		err := RotateMasterKey()
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	// the old master key can't unwrap the data key anymore
+	err = InitSecretEncryption()
+	if err == nil {
+		t.Fatal("the old master key should be rejected after the rotation")
+	}
+
+	t.Setenv("MASTER_KEY", "rotated-master-key")
+	err = InitSecretEncryption()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := GetChannelById(channel.Id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Key != "sk-rotated" {
+		t.Errorf("key = %q after the rotation, want %q", stored.Key, "sk-rotated")
+	}
+}
+
+func TestRotateMasterKeyWithoutNewKey(t *testing.T) {
+	t.Setenv("NEW_MASTER_KEY", "")
+	t.Setenv("NEW_MASTER_KEY_FILE", "")
+	err := RotateMasterKey()
+	if err == nil {
+		t.Error("the rotation should fail without NEW_MASTER_KEY")
+	}
+}
+
+func TestInitSecretEncryptionWithoutMasterKey(t *testing.T) {
+	t.Setenv("MASTER_KEY", "")
+	t.Setenv("MASTER_KEY_FILE", "")
+	err := InitSecretEncryption()
+	if err == nil {
+		t.Error("the startup should fail when the secrets are encrypted but the master key is not set")
+	}
+}
+
+func TestDecryptSecretFieldKeepsTheValueOnError(t *testing.T) {
+	field := "enc:v1:not-a-valid-ciphertext"
+	err := decryptSecretField(&field)
+	if err == nil {
+		t.Fatal("decrypting an invalid ciphertext should fail")
+	}
+	if field != "enc:v1:not-a-valid-ciphertext" {
+		t.Errorf("field = %q, want the value kept", field)
+	}
+}
+
+func TestInitGeneratedOptionKeepsTheFirstValue(t *testing.T) {
+	generate := func(value string) func() (string, error) {
+		return func() (string, error) {
+			return value, nil
+		}
+	}
+	t.Cleanup(func() {
+		DB.Delete(&Option{Key: "TestGeneratedOption"})
+	})
+	value, generated, err := initGeneratedOption("TestGeneratedOption", generate("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "first" || !generated {
+		t.Errorf("value = %q, generated = %v, want %q and true", value, generated, "first")
+	}
+	value, generated, err = initGeneratedOption("TestGeneratedOption", generate("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "first" || generated {
+		t.Errorf("value = %q, generated = %v, want the first value kept", value, generated)
+	}
+}
@@ -1,16 +1,26 @@
 package model
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"gorm.io/gorm"
+	"net"
 	"one-api/common"
+	"one-api/common/notify"
+	"strings"
+	"time"
 )
 
+const tokenKeyPrefixLength = 8
+
 type Token struct {
 	Id             int    `json:"id"`
 	UserId         int    `json:"user_id"`
-	Key            string `json:"key" gorm:"type:char(48);uniqueIndex"`
+	Key            string `json:"key,omitempty" gorm:"-:all"` // only returned once on creation, never stored
+	KeyHash        string `json:"-" gorm:"type:char(64);uniqueIndex"`
+	KeyPrefix      string `json:"key_prefix" gorm:"type:varchar(16)"` // for display only
 	Status         int    `json:"status" gorm:"default:1"`
 	Name           string `json:"name" gorm:"index" `
 	CreatedTime    int64  `json:"created_time" gorm:"bigint"`
@@ -18,6 +28,27 @@ type Token struct {
 	ExpiredTime    int64  `json:"expired_time" gorm:"bigint;default:-1"` // -1 means never expired
 	RemainQuota    int    `json:"remain_quota" gorm:"default:0"`
 	UnlimitedQuota bool   `json:"unlimited_quota" gorm:"default:false"`
+	Models         string `json:"models"`                                          // comma separated model patterns, empty means no restriction
+	Group          string `json:"group" gorm:"type:varchar(32);default:''"`        // overrides the user's group if not empty, only admin can set it
+	Subnet         string `json:"subnet"`                                          // comma separated CIDRs, empty means no restriction
+	RateLimitRPM   int    `json:"rate_limit_rpm" gorm:"default:0"`                 // requests per minute, 0 means unlimited
+	RateLimitTPM   int    `json:"rate_limit_tpm" gorm:"default:0"`                 // tokens per minute, 0 means unlimited
+	QuotaPeriod    string `json:"quota_period" gorm:"type:varchar(16);default:''"` // daily, weekly or monthly, empty means no period
+	PeriodQuota    int    `json:"period_quota" gorm:"default:0"`                   // the remain quota is reset to this at the start of each period
+	PeriodStart    int64  `json:"period_start" gorm:"bigint;default:0"`
+	ContentLogging bool   `json:"content_logging" gorm:"default:false"` // capture the requests & responses, only root can set it
+
+	subnets []*net.IPNet // parsed from Subnet when the token is loaded
+}
+
+func (token *Token) AfterFind(tx *gorm.DB) error {
+	token.subnets = common.ParseSubnets(token.Subnet)
+	return nil
+}
+
+// IsIpAllowed reports whether the token can be used from the ip
+func (token *Token) IsIpAllowed(ip string) bool {
+	return common.IsIpInSubnets(ip, token.subnets)
 }
 
 func GetAllUserTokens(userId int, startIdx int, num int) ([]*Token, error) {
@@ -37,8 +68,14 @@ func ValidateUserToken(key string) (token *Token, err error) {
 		return nil, errors.New("未提供 token")
 	}
 	token = &Token{}
-	err = DB.Where("`key` = ?", key).First(token).Error
+	err = DB.Where("key_hash = ?", common.HashTokenKey(key)).First(token).Error
 	if err == nil {
+		if token.IsPeriodOver() {
+			err := token.ResetPeriodQuota()
+			if err != nil {
+				common.SysError("重置 token 周期额度失败：" + err.Error())
+			}
+		}
 		if token.Status != common.TokenStatusEnabled {
 			return nil, errors.New("该 token 状态不可用")
 		}
@@ -51,11 +88,7 @@ func ValidateUserToken(key string) (token *Token, err error) {
 			return nil, errors.New("该 token 已过期")
 		}
 		if !token.UnlimitedQuota && token.RemainQuota <= 0 {
-			token.Status = common.TokenStatusExhausted
-			err := token.SelectUpdate()
-			if err != nil {
-				common.SysError("更新 token 状态失败：" + err.Error())
-			}
+			markTokenExhausted(token.Id)
 			return nil, errors.New("该 token 额度已用尽")
 		}
 		go func() {
@@ -92,6 +125,8 @@ func GetTokenById(id int) (*Token, error) {
 
 func (token *Token) Insert() error {
 	var err error
+	token.KeyHash = common.HashTokenKey(token.Key)
+	token.KeyPrefix = token.Key[:tokenKeyPrefixLength]
 	err = DB.Create(token).Error
 	return err
 }
@@ -99,10 +134,70 @@ func (token *Token) Insert() error {
 // Update Make sure your token's fields is completed, because this will update non-zero values
 func (token *Token) Update() error {
 	var err error
-	err = DB.Model(token).Select("name", "status", "expired_time", "remain_quota", "unlimited_quota").Updates(token).Error
+	err = DB.Model(token).Select("name", "status", "expired_time", "remain_quota", "unlimited_quota", "models", "group", "subnet", "rate_limit_rpm", "rate_limit_tpm", "quota_period", "period_quota", "period_start").Updates(token).Error
 	return err
 }
 
+// SetTokenGroup overrides the group of the token of any user, only admin can do it
+func SetTokenGroup(tokenId int, group string) error {
+	return DB.Model(&Token{}).Where("id = ?", tokenId).Update("group", group).Error
+}
+
+func (token *Token) IsPeriodOver() bool {
+	return token.QuotaPeriod != "" && token.PeriodStart < common.GetQuotaPeriodStart(token.QuotaPeriod, time.Now())
+}
+
+// ResetPeriodQuota starts a new period, an exhausted token is enabled again,
+// only one of the concurrent requests & the reset job resets it, the others read the token again
+func (token *Token) ResetPeriodQuota() error {
+	periodStart := common.GetQuotaPeriodStart(token.QuotaPeriod, time.Now())
+	result := DB.Model(&Token{}).Where("id = ? and period_start < ?", token.Id, periodStart).Updates(map[string]interface{}{
+		"period_start": periodStart,
+		"remain_quota": gorm.Expr("period_quota"),
+		"status":       gorm.Expr("CASE WHEN status = ? THEN ? ELSE status END", common.TokenStatusExhausted, common.TokenStatusEnabled),
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected != 1 {
+		// reset by someone else, the quota may have been consumed since then
+		return DB.First(token, "id = ?", token.Id).Error
+	}
+	token.PeriodStart = periodStart
+	token.RemainQuota = token.PeriodQuota
+	if token.Status == common.TokenStatusExhausted {
+		token.Status = common.TokenStatusEnabled
+	}
+	return nil
+}
+
+// ResetTokenPeriodQuotas resets all the tokens whose period is over
+func ResetTokenPeriodQuotas() error {
+	now := time.Now()
+	for _, period := range []string{common.TokenQuotaPeriodDaily, common.TokenQuotaPeriodWeekly, common.TokenQuotaPeriodMonthly} {
+		periodStart := common.GetQuotaPeriodStart(period, now)
+		err := DB.Model(&Token{}).Where("quota_period = ? and period_start < ?", period, periodStart).Updates(map[string]interface{}{
+			"period_start": periodStart,
+			"remain_quota": gorm.Expr("period_quota"),
+			"status":       gorm.Expr("CASE WHEN status = ? THEN ? ELSE status END", common.TokenStatusExhausted, common.TokenStatusEnabled),
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func AutomaticallyResetTokenPeriodQuotas(frequency int) {
+	for {
+		time.Sleep(time.Duration(frequency) * time.Second)
+		err := ResetTokenPeriodQuotas()
+		if err != nil {
+			common.SysError("failed to reset token period quotas: " + err.Error())
+		}
+	}
+}
+
 func (token *Token) SelectUpdate() error {
 	// This can update zero values
 	return DB.Model(token).Select("accessed_time", "status").Updates(token).Error
@@ -161,6 +256,10 @@ func PreConsumeTokenQuota(tokenId int, quota int) (err error) {
 	if userQuota < quota {
 		return errors.New("用户额度不足")
 	}
+	err = ReserveUserBudget(token.UserId, quota)
+	if err != nil {
+		return err
+	}
 	quotaTooLow := userQuota >= common.QuotaRemindThreshold && userQuota-quota < common.QuotaRemindThreshold
 	noMoreQuota := userQuota-quota <= 0
 	if quotaTooLow || noMoreQuota {
@@ -173,24 +272,26 @@ func PreConsumeTokenQuota(tokenId int, quota int) (err error) {
 			if noMoreQuota {
 				prompt = "您的额度已用尽"
 			}
+			topUpLink := fmt.Sprintf("%s/topup", common.ServerAddress)
+			content := fmt.Sprintf("%s，当前剩余额度为 %d，为了不影响您的使用，请及时充值。<br/>充值链接：<a href='%s'>%s</a>", prompt, userQuota, topUpLink, topUpLink)
 			if email != "" {
-				topUpLink := fmt.Sprintf("%s/topup", common.ServerAddress)
-				err = common.SendEmail(prompt, email,
-					fmt.Sprintf("%s，当前剩余额度为 %d，为了不影响您的使用，请及时充值。<br/>充值链接：<a href='%s'>%s</a>", prompt, userQuota, topUpLink, topUpLink))
-				if err != nil {
-					common.SysError("发送邮件失败：" + err.Error())
-				}
+				notify.SendTo(&notify.EmailNotifier{To: email}, notify.EventQuotaLow, prompt, content)
 			}
 		}()
 	}
 	if !token.UnlimitedQuota {
 		err = DecreaseTokenQuota(tokenId, quota)
 		if err != nil {
+			AddUserSpending(token.UserId, -quota)
 			return err
 		}
 	}
 	err = DecreaseUserQuota(token.UserId, quota)
-	return err
+	if err != nil {
+		AddUserSpending(token.UserId, -quota)
+		return err
+	}
+	return nil
 }
 
 func PostConsumeTokenQuota(tokenId int, quota int) (err error) {
@@ -203,6 +304,7 @@ func PostConsumeTokenQuota(tokenId int, quota int) (err error) {
 	if err != nil {
 		return err
 	}
+	AddUserSpending(token.UserId, quota)
 	if !token.UnlimitedQuota {
 		if quota > 0 {
 			err = DecreaseTokenQuota(tokenId, quota)
@@ -212,6 +314,103 @@ func PostConsumeTokenQuota(tokenId int, quota int) (err error) {
 		if err != nil {
 			return err
 		}
+		// the request which drains the token exhausts it, not the next one
+		markTokenExhausted(tokenId)
+	}
+	return nil
+}
+
+// markTokenExhausted sets the status of the token to exhausted if its quota is used up,
+// only the caller which changes the status emits the event so it's emitted once
+func markTokenExhausted(tokenId int) {
+	result := DB.Model(&Token{}).Where("id = ? and status = ? and unlimited_quota = ? and remain_quota <= ?",
+		tokenId, common.TokenStatusEnabled, false, 0).Update("status", common.TokenStatusExhausted)
+	if result.Error != nil {
+		common.SysError("更新 token 状态失败：" + result.Error.Error())
+		return
+	}
+	if result.RowsAffected == 0 {
+		return
+	}
+	token, err := GetTokenById(tokenId)
+	if err != nil {
+		common.SysError("获取 token 失败：" + err.Error())
+		return
+	}
+	EmitWebhookEvent(WebhookEventTokenExhausted, map[string]any{
+		"token_id":   token.Id,
+		"token_name": token.Name,
+		"user_id":    token.UserId,
+	})
+}
+
+// The salt of token key hashes, never loaded into the option map
+const tokenKeySaltOption = "TokenKeySalt"
+
+func initTokenKeySalt() error {
+	value, _, err := initGeneratedOption(tokenKeySaltOption, func() (string, error) {
+		salt := make([]byte, 32)
+		_, err := rand.Read(salt)
+		if err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(salt), nil
+	})
+	if err != nil {
+		return err
+	}
+	salt, err := hex.DecodeString(value)
+	if err != nil {
+		return err
+	}
+	common.TokenKeySalt = salt
+	return nil
+}
+
+// migrateTokenKeys hashes the plaintext keys of the tokens created before keys were hashed,
+// the plaintext keys are removed afterwards
+func migrateTokenKeys() error {
+	columnTypes, err := DB.Migrator().ColumnTypes(&Token{})
+	if err != nil {
+		return err
+	}
+	hasKeyColumn := false
+	for _, columnType := range columnTypes {
+		if columnType.Name() == "key" {
+			hasKeyColumn = true
+		}
+	}
+	if !hasKeyColumn {
+		return nil
+	}
+	var rows []map[string]interface{}
+	err = DB.Table("tokens").Select("id", "key").Where("key_hash is null or key_hash = ?", "").Find(&rows).Error
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		var key string
+		switch v := row["key"].(type) {
+		case string:
+			key = v
+		case []byte:
+			key = string(v)
+		}
+		key = strings.TrimSpace(key)
+		if len(key) < tokenKeyPrefixLength {
+			continue
+		}
+		err = DB.Table("tokens").Where("id = ?", row["id"]).Updates(map[string]interface{}{
+			"key_hash":   common.HashTokenKey(key),
+			"key_prefix": key[:tokenKeyPrefixLength],
+			"key":        nil,
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+	if len(rows) != 0 {
+		common.SysLog(fmt.Sprintf("%d token keys hashed", len(rows)))
 	}
 	return nil
 }
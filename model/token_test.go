@@ -0,0 +1,154 @@
+package model
+
+import (
+	"database/sql"
+	"gorm.io/gorm"
+	"one-api/common"
+	"testing"
+)
+
+func TestTokenKeyIsHashed(t *testing.T) {
+	key := common.GetUUID() + "abcdefghijklmnop"
+	token := &Token{UserId: 1, Name: "hashed", Key: key, Status: common.TokenStatusEnabled, ExpiredTime: -1, UnlimitedQuota: true}
+	err := token.Insert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.KeyHash == "" || token.KeyHash == key {
+		t.Fatalf("key hash = %q, want the hash of the key", token.KeyHash)
+	}
+	if token.KeyPrefix != key[:tokenKeyPrefixLength] {
+		t.Errorf("key prefix = %q, want %q", token.KeyPrefix, key[:tokenKeyPrefixLength])
+	}
+	found, err := ValidateUserToken(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Id != token.Id {
+		t.Errorf("token id = %d, want %d", found.Id, token.Id)
+	}
+	_, err = ValidateUserToken(key + "x")
+	if err == nil {
+		t.Error("a wrong key should be rejected")
+	}
+}
+
+func TestHashTokenKeyDependsOnSalt(t *testing.T) {
+	salt := common.TokenKeySalt
+	t.Cleanup(func() {
+		common.TokenKeySalt = salt
+	})
+	hash := common.HashTokenKey("sk-same-key")
+	if common.HashTokenKey("sk-same-key") != hash {
+		t.Fatal("the hash should be deterministic")
+	}
+	common.TokenKeySalt = []byte("another salt")
+	if common.HashTokenKey("sk-same-key") == hash {
+		t.Error("the hash should depend on the salt")
+	}
+}
+
+func TestMigrateTokenKeys(t *testing.T) {
+	// the tokens table of the versions before keys were hashed
+	columnTypes, err := DB.Migrator().ColumnTypes(&Token{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hasKeyColumn := false
+	for _, columnType := range columnTypes {
+		if columnType.Name() == "key" {
+			hasKeyColumn = true
+		}
+	}
+	if !hasKeyColumn {
+		err = DB.Exec(`ALTER TABLE tokens ADD COLUMN "key" char(48)`).Error
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the cached statements still select the columns from before the change
+		if preparedStmt, ok := DB.ConnPool.(*gorm.PreparedStmtDB); ok {
+			preparedStmt.Close()
+		}
+	}
+	key := common.GetUUID() + "legacykeylegacyk"
+	err = DB.Exec(`INSERT INTO tokens (user_id, name, "key", status, expired_time, unlimited_quota) VALUES (?, ?, ?, ?, ?, ?)`,
+		1, "legacy", key, common.TokenStatusEnabled, -1, true).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ValidateUserToken(key)
+	if err == nil {
+		t.Fatal("the legacy token should not be found before the migration")
+	}
+
+	err = migrateTokenKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := ValidateUserToken(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.Name != "legacy" || token.KeyPrefix != key[:tokenKeyPrefixLength] {
+		t.Errorf("name = %q, key prefix = %q, want the legacy token", token.Name, token.KeyPrefix)
+	}
+	var plaintext sql.NullString
+	err = DB.Table("tokens").Select(`"key"`).Where("id = ?", token.Id).Scan(&plaintext).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext.Valid {
+		t.Errorf("the plaintext key should be removed, got %q", plaintext.String)
+	}
+
+	// running it again changes nothing
+	err = migrateTokenKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ValidateUserToken(key)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTokenSubnetsParsedOnLoad(t *testing.T) {
+	key := common.GetUUID() + "subnetsubnetsubn"
+	token := &Token{UserId: 1, Name: "subnet", Key: key, Status: common.TokenStatusEnabled, ExpiredTime: -1, UnlimitedQuota: true, Subnet: "10.0.0.0/8"}
+	err := token.Insert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := ValidateUserToken(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found.IsIpAllowed("10.1.2.3") || found.IsIpAllowed("192.168.1.1") {
+		t.Error("the subnets of the loaded token should be enforced")
+	}
+}
+
+func TestTokenExhaustedWhenQuotaIsUsedUp(t *testing.T) {
+	key := common.GetUUID() + "exhaustexhaustex"
+	token := &Token{UserId: 1, Name: "exhausted", Key: key, Status: common.TokenStatusEnabled, ExpiredTime: -1, RemainQuota: 100}
+	err := token.Insert()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = PostConsumeTokenQuota(token.Id, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _ = GetTokenById(token.Id)
+	if token.Status != common.TokenStatusEnabled {
+		t.Errorf("status = %d, want the token enabled with quota left", token.Status)
+	}
+	err = PostConsumeTokenQuota(token.Id, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _ = GetTokenById(token.Id)
+	if token.Status != common.TokenStatusExhausted {
+		t.Errorf("status = %d, want the token exhausted by the request which used up its quota", token.Status)
+	}
+}
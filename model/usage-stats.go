@@ -0,0 +1,300 @@
+package model
+
+import (
+	"errors"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"one-api/common"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	UsageStatGranularityHour = 60 * 60
+	UsageStatGranularityDay  = 24 * 60 * 60
+)
+
+var usageStatGranularities = []int{UsageStatGranularityHour, UsageStatGranularityDay}
+
+// UsageStat is the rollup of the consume logs of a user, token, model & channel in an hour or a day (in UTC),
+// it is updated as the consume logs are written
+type UsageStat struct {
+	Id               int    `json:"id"`
+	Granularity      int    `json:"granularity" gorm:"uniqueIndex:idx_usage_stat,priority:1"`
+	PeriodStart      int64  `json:"period_start" gorm:"bigint;uniqueIndex:idx_usage_stat,priority:2"`
+	UserId           int    `json:"user_id" gorm:"uniqueIndex:idx_usage_stat,priority:3;index"`
+	TokenId          int    `json:"token_id" gorm:"uniqueIndex:idx_usage_stat,priority:4"`
+	ModelName        string `json:"model_name" gorm:"type:varchar(128);uniqueIndex:idx_usage_stat,priority:5"`
+	ChannelId        int    `json:"channel_id" gorm:"uniqueIndex:idx_usage_stat,priority:6"`
+	Requests         int64  `json:"requests" gorm:"default:0"`
+	PromptTokens     int64  `json:"prompt_tokens" gorm:"default:0"`
+	CompletionTokens int64  `json:"completion_tokens" gorm:"default:0"`
+	Quota            int64  `json:"quota" gorm:"default:0"`
+}
+
+type UsageStatPoint struct {
+	PeriodStart      int64 `json:"period_start"`
+	Requests         int64 `json:"requests"`
+	PromptTokens     int64 `json:"prompt_tokens"`
+	CompletionTokens int64 `json:"completion_tokens"`
+	Quota            int64 `json:"quota"`
+}
+
+type UsageStatTop struct {
+	Key              string `json:"key" gorm:"column:group_key"`
+	Name             string `json:"name" gorm:"-"`
+	Requests         int64  `json:"requests"`
+	PromptTokens     int64  `json:"prompt_tokens"`
+	CompletionTokens int64  `json:"completion_tokens"`
+	Quota            int64  `json:"quota"`
+}
+
+type UsageStatFilter struct {
+	Granularity    int
+	UserId         int
+	TokenId        int
+	ModelName      string
+	ChannelId      int
+	StartTimestamp int64
+	EndTimestamp   int64
+}
+
+// the columns which the top usage can be grouped by, and the tables & columns of their names
+var usageStatDimensions = map[string]string{
+	"user":    "user_id",
+	"token":   "token_id",
+	"model":   "model_name",
+	"channel": "channel_id",
+}
+
+var usageStatDimensionNames = map[string][2]string{
+	"user":    {"users", "username"},
+	"token":   {"tokens", "name"},
+	"channel": {"channels", "name"},
+}
+
+var usageStatOrders = map[string]bool{
+	"requests":          true,
+	"prompt_tokens":     true,
+	"completion_tokens": true,
+	"quota":             true,
+}
+
+const usageStatSums = "sum(requests) as requests, sum(prompt_tokens) as prompt_tokens, sum(completion_tokens) as completion_tokens, sum(quota) as quota"
+
+var usageStatConflictColumns = []clause.Column{
+	{Name: "granularity"}, {Name: "period_start"}, {Name: "user_id"}, {Name: "token_id"}, {Name: "model_name"}, {Name: "channel_id"},
+}
+
+// the rollup of the consume logs not written to the database yet, keyed by the unique columns of UsageStat,
+// it is flushed every few seconds so the request path doesn't wait for the upserts
+var pendingUsageStats = make(map[UsageStat]*UsageStat)
+var pendingUsageStatsLock sync.Mutex
+
+func updateUsageStats(log *Log) {
+	pendingUsageStatsLock.Lock()
+	defer pendingUsageStatsLock.Unlock()
+	for _, granularity := range usageStatGranularities {
+		key := UsageStat{
+			Granularity: granularity,
+			PeriodStart: log.CreatedAt - log.CreatedAt%int64(granularity),
+			UserId:      log.UserId,
+			TokenId:     log.TokenId,
+			ModelName:   log.ModelName,
+			ChannelId:   log.ChannelId,
+		}
+		stat, ok := pendingUsageStats[key]
+		if !ok {
+			stat = &UsageStat{}
+			*stat = key
+			pendingUsageStats[key] = stat
+		}
+		stat.Requests++
+		stat.PromptTokens += int64(log.PromptTokens)
+		stat.CompletionTokens += int64(log.CompletionTokens)
+		stat.Quota += int64(log.Quota)
+	}
+}
+
+func flushUsageStats() {
+	pendingUsageStatsLock.Lock()
+	stats := pendingUsageStats
+	pendingUsageStats = make(map[UsageStat]*UsageStat)
+	pendingUsageStatsLock.Unlock()
+	for _, stat := range stats {
+		err := DB.Clauses(clause.OnConflict{
+			Columns: usageStatConflictColumns,
+			DoUpdates: clause.Assignments(map[string]any{
+				"requests":          gorm.Expr("requests + ?", stat.Requests),
+				"prompt_tokens":     gorm.Expr("prompt_tokens + ?", stat.PromptTokens),
+				"completion_tokens": gorm.Expr("completion_tokens + ?", stat.CompletionTokens),
+				"quota":             gorm.Expr("quota + ?", stat.Quota),
+			}),
+		}).Create(stat).Error
+		if err != nil {
+			common.SysError("failed to update usage stats: " + err.Error())
+		}
+	}
+}
+
+// FlushUsageStats writes the rollup of the latest consume logs periodically,
+// the usage of the last few seconds may be lost on restart
+func FlushUsageStats(frequency int) {
+	for {
+		time.Sleep(time.Duration(frequency) * time.Second)
+		flushUsageStats()
+	}
+}
+
+// The option recording that the usage stats were built from the consume logs, never loaded into the option map
+const usageStatsBackfilledOption = "UsageStatsBackfilled"
+
+// backfillUsageStats builds the rollup from the existing consume logs once
+func backfillUsageStats() error {
+	option := Option{Key: usageStatsBackfilledOption}
+	result := DB.Where(&Option{Key: usageStatsBackfilledOption}).Limit(1).Find(&option)
+	if result.Error != nil || result.RowsAffected != 0 {
+		return result.Error
+	}
+	option.Value = "true"
+	var count int64
+	err := DB.Model(&UsageStat{}).Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count != 0 {
+		// built by the versions before the option was recorded
+		return DB.Create(&option).Error
+	}
+	var stats []*UsageStat
+	for _, granularity := range usageStatGranularities {
+		periodStart := "created_at - created_at % " + strconv.Itoa(granularity)
+		rows, err := DB.Model(&Log{}).
+			Select(periodStart+" as period_start, user_id, token_id, model_name, channel_id, count(*) as requests, sum(prompt_tokens) as prompt_tokens, sum(completion_tokens) as completion_tokens, sum(quota) as quota").
+			Where("type = ?", LogTypeConsume).
+			Group(periodStart + ", user_id, token_id, model_name, channel_id").
+			Rows()
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			stat := &UsageStat{}
+			err = DB.ScanRows(rows, stat)
+			if err != nil {
+				break
+			}
+			stat.Granularity = granularity
+			stats = append(stats, stat)
+		}
+		_ = rows.Close()
+		if err != nil {
+			return err
+		}
+	}
+	// the rollup & the option are written together, so a failed backfill is retried on the next start
+	err = DB.Transaction(func(tx *gorm.DB) error {
+		if len(stats) != 0 {
+			// keep the number of variables of a batch below the limit of SQLite
+			err := tx.CreateInBatches(stats, 50).Error
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Create(&option).Error
+	})
+	if err != nil {
+		return err
+	}
+	common.SysLog("usage stats backfilled: " + strconv.Itoa(len(stats)) + " rows")
+	return nil
+}
+
+func (filter *UsageStatFilter) apply(tx *gorm.DB) *gorm.DB {
+	tx = tx.Where("granularity = ?", filter.Granularity)
+	if filter.UserId != 0 {
+		tx = tx.Where("user_id = ?", filter.UserId)
+	}
+	if filter.TokenId != 0 {
+		tx = tx.Where("token_id = ?", filter.TokenId)
+	}
+	if filter.ModelName != "" {
+		tx = tx.Where("model_name = ?", filter.ModelName)
+	}
+	if filter.ChannelId != 0 {
+		tx = tx.Where("channel_id = ?", filter.ChannelId)
+	}
+	if filter.StartTimestamp != 0 {
+		tx = tx.Where("period_start >= ?", filter.StartTimestamp)
+	}
+	if filter.EndTimestamp != 0 {
+		tx = tx.Where("period_start <= ?", filter.EndTimestamp)
+	}
+	return tx
+}
+
+// GetUsageStats returns the usage of each period in the range, the periods without usage are omitted
+func GetUsageStats(filter *UsageStatFilter) (points []*UsageStatPoint, err error) {
+	err = filter.apply(DB.Model(&UsageStat{})).
+		Select("period_start, " + usageStatSums).
+		Group("period_start").
+		Order("period_start").
+		Scan(&points).Error
+	return points, err
+}
+
+// GetTopUsageStats returns the top usage grouped by the dimension, which is user, token, model or channel
+func GetTopUsageStats(filter *UsageStatFilter, dimension string, orderBy string, limit int) (tops []*UsageStatTop, err error) {
+	column, ok := usageStatDimensions[dimension]
+	if !ok {
+		return nil, errors.New("invalid dimension: " + dimension)
+	}
+	if !usageStatOrders[orderBy] {
+		return nil, errors.New("invalid order: " + orderBy)
+	}
+	err = filter.apply(DB.Model(&UsageStat{})).
+		Select(column + " as group_key, " + usageStatSums).
+		Group(column).
+		Order(orderBy + " desc").
+		Limit(limit).
+		Scan(&tops).Error
+	if err != nil {
+		return nil, err
+	}
+	fillUsageStatNames(dimension, tops)
+	return tops, nil
+}
+
+func fillUsageStatNames(dimension string, tops []*UsageStatTop) {
+	if dimension == "model" {
+		for _, top := range tops {
+			top.Name = top.Key
+		}
+		return
+	}
+	table := usageStatDimensionNames[dimension]
+	ids := make([]int, 0, len(tops))
+	for _, top := range tops {
+		id, _ := strconv.Atoi(top.Key)
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return
+	}
+	var rows []struct {
+		Id   int
+		Name string
+	}
+	err := DB.Table(table[0]).Select("id, "+table[1]+" as name").Where("id in ?", ids).Scan(&rows).Error
+	if err != nil {
+		common.SysError("failed to get the names of usage stats: " + err.Error())
+		return
+	}
+	names := make(map[string]string, len(rows))
+	for _, row := range rows {
+		names[strconv.Itoa(row.Id)] = row.Name
+	}
+	for _, top := range tops {
+		top.Name = names[top.Key]
+	}
+}
@@ -0,0 +1,306 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"math"
+	"one-api/common"
+	"one-api/common/notify"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UserBudget holds the spending caps and alert thresholds set by a user,
+// the spending is counted from the consume logs when the budget is set and tracked afterwards
+type UserBudget struct {
+	UserId          int    `json:"user_id" gorm:"primaryKey;autoIncrement:false"`
+	DailyLimit      int    `json:"daily_limit" gorm:"default:0"`   // 0 means unlimited
+	MonthlyLimit    int    `json:"monthly_limit" gorm:"default:0"` // 0 means unlimited
+	AlertThresholds string `json:"alert_thresholds"`               // comma separated, percentages of the limits (e.g. 80%) or absolute quota (e.g. 500000)
+	DailyUsed       int    `json:"daily_used" gorm:"default:0"`
+	MonthlyUsed     int    `json:"monthly_used" gorm:"default:0"`
+	DailyStart      int64  `json:"daily_start" gorm:"bigint;default:0"`
+	MonthlyStart    int64  `json:"monthly_start" gorm:"bigint;default:0"`
+	// the sinks of the alerts in the format of the NotificationSinks option, email sinks are sent to the email of the user,
+	// the alerts are sent to the email of the user if it is empty
+	NotificationSinks string `json:"notification_sinks" gorm:"type:text"`
+	DailyAlerted      int    `json:"-" gorm:"default:0"` // the highest threshold alerted in the current day
+	MonthlyAlerted    int    `json:"-" gorm:"default:0"` // the highest threshold alerted in the current month
+}
+
+type budgetThreshold struct {
+	value     float64
+	isPercent bool
+}
+
+func parseBudgetThresholds(thresholds string) ([]budgetThreshold, error) {
+	result := make([]budgetThreshold, 0)
+	for _, threshold := range strings.Split(thresholds, ",") {
+		threshold = strings.TrimSpace(threshold)
+		if threshold == "" {
+			continue
+		}
+		isPercent := strings.HasSuffix(threshold, "%")
+		value, err := strconv.ParseFloat(strings.TrimSuffix(threshold, "%"), 64)
+		if err != nil || value <= 0 {
+			return nil, fmt.Errorf("无效的提醒阈值：%s", threshold)
+		}
+		result = append(result, budgetThreshold{value: value, isPercent: isPercent})
+	}
+	return result, nil
+}
+
+func ValidateBudgetThresholds(thresholds string) error {
+	_, err := parseBudgetThresholds(thresholds)
+	return err
+}
+
+func GetUserBudget(userId int) (*UserBudget, error) {
+	budget := &UserBudget{}
+	result := DB.Where("user_id = ?", userId).Limit(1).Find(budget)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+	now := time.Now()
+	if budget.isPeriodOver(now) {
+		err := rollOverUserBudget(userId, now)
+		if err != nil {
+			return nil, err
+		}
+		err = DB.First(budget, "user_id = ?", userId).Error
+		if err != nil {
+			return nil, err
+		}
+	}
+	return budget, nil
+}
+
+func (budget *UserBudget) isPeriodOver(now time.Time) bool {
+	return budget.DailyStart < common.GetQuotaPeriodStart(common.TokenQuotaPeriodDaily, now) ||
+		budget.MonthlyStart < common.GetQuotaPeriodStart(common.TokenQuotaPeriodMonthly, now)
+}
+
+// rollOverUserBudget clears the spending of the periods which are over, the conditions make sure a period is
+// cleared only once, so the spending added by concurrent requests since then is kept
+func rollOverUserBudget(userId int, now time.Time) error {
+	dailyStart := common.GetQuotaPeriodStart(common.TokenQuotaPeriodDaily, now)
+	err := DB.Model(&UserBudget{}).Where("user_id = ? and daily_start < ?", userId, dailyStart).Updates(map[string]interface{}{
+		"daily_start":   dailyStart,
+		"daily_used":    0,
+		"daily_alerted": 0,
+	}).Error
+	if err != nil {
+		return err
+	}
+	monthlyStart := common.GetQuotaPeriodStart(common.TokenQuotaPeriodMonthly, now)
+	return DB.Model(&UserBudget{}).Where("user_id = ? and monthly_start < ?", userId, monthlyStart).Updates(map[string]interface{}{
+		"monthly_start":   monthlyStart,
+		"monthly_used":    0,
+		"monthly_alerted": 0,
+	}).Error
+}
+
+func sumConsumedQuota(userId int, since int64) (int, error) {
+	var quota int
+	err := DB.Model(&Log{}).Where("user_id = ? and type = ? and created_at >= ?", userId, LogTypeConsume, since).
+		Select("COALESCE(SUM(quota), 0)").Scan(&quota).Error
+	return quota, err
+}
+
+// SetUserBudget saves the budget of the user, the spending of the current periods is counted from the consume logs
+func SetUserBudget(budget *UserBudget) error {
+	err := ValidateBudgetThresholds(budget.AlertThresholds)
+	if err != nil {
+		return err
+	}
+	if budget.DailyLimit < 0 || budget.MonthlyLimit < 0 {
+		return errors.New("消费上限不能为负数")
+	}
+	if budget.NotificationSinks != "" {
+		_, err = notify.ParseUserSinks(budget.NotificationSinks)
+		if err != nil {
+			return fmt.Errorf("无效的通知渠道：%s", err.Error())
+		}
+	}
+	now := time.Now()
+	budget.DailyStart = common.GetQuotaPeriodStart(common.TokenQuotaPeriodDaily, now)
+	budget.MonthlyStart = common.GetQuotaPeriodStart(common.TokenQuotaPeriodMonthly, now)
+	budget.DailyUsed, err = sumConsumedQuota(budget.UserId, budget.DailyStart)
+	if err != nil {
+		return err
+	}
+	budget.MonthlyUsed, err = sumConsumedQuota(budget.UserId, budget.MonthlyStart)
+	if err != nil {
+		return err
+	}
+	// the thresholds already reached are not alerted again
+	thresholds, _ := parseBudgetThresholds(budget.AlertThresholds)
+	budget.DailyAlerted = reachedBudgetThreshold(thresholds, budget.DailyLimit, budget.DailyUsed)
+	budget.MonthlyAlerted = reachedBudgetThreshold(thresholds, budget.MonthlyLimit, budget.MonthlyUsed)
+	return DB.Save(budget).Error
+}
+
+// ReserveUserBudget adds the quota to the spending of the user if it stays within the caps, the check & the
+// increment are a single update so concurrent requests can't overspend, the reservation is settled or refunded
+// with AddUserSpending after the request
+func ReserveUserBudget(userId int, quota int) error {
+	for attempt := 0; attempt < 2; attempt++ {
+		budget, err := GetUserBudget(userId)
+		if err != nil || budget == nil {
+			return err
+		}
+		if budget.DailyLimit > 0 && budget.DailyUsed+quota > budget.DailyLimit {
+			return errors.New("已超出每日消费上限")
+		}
+		if budget.MonthlyLimit > 0 && budget.MonthlyUsed+quota > budget.MonthlyLimit {
+			return errors.New("已超出每月消费上限")
+		}
+		if quota == 0 {
+			return nil
+		}
+		result := DB.Model(&UserBudget{}).
+			Where("user_id = ? and daily_start = ? and monthly_start = ?", userId, budget.DailyStart, budget.MonthlyStart).
+			Where("(daily_limit = 0 or daily_used + ? <= daily_limit) and (monthly_limit = 0 or monthly_used + ? <= monthly_limit)", quota, quota).
+			Updates(map[string]interface{}{
+				"daily_used":   gorm.Expr("daily_used + ?", quota),
+				"monthly_used": gorm.Expr("monthly_used + ?", quota),
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 1 {
+			checkUserBudgetAlerts(userId)
+			return nil
+		}
+		// the spending grew or a period rolled over since the budget was read, check again with the latest one
+	}
+	return errors.New("已超出消费上限")
+}
+
+// AddUserSpending settles the spending of the user, a negative quota refunds a reservation,
+// the spending never drops below zero in case the period rolled over since the reservation
+func AddUserSpending(userId int, quota int) {
+	if quota == 0 {
+		return
+	}
+	budget, err := GetUserBudget(userId)
+	if err != nil {
+		common.SysError("failed to get user budget: " + err.Error())
+		return
+	}
+	if budget == nil {
+		return
+	}
+	err = DB.Model(&UserBudget{}).Where("user_id = ?", userId).Updates(map[string]interface{}{
+		"daily_used":   gorm.Expr("CASE WHEN daily_used + ? > 0 THEN daily_used + ? ELSE 0 END", quota, quota),
+		"monthly_used": gorm.Expr("CASE WHEN monthly_used + ? > 0 THEN monthly_used + ? ELSE 0 END", quota, quota),
+	}).Error
+	if err != nil {
+		common.SysError("failed to update user spending: " + err.Error())
+		return
+	}
+	if quota > 0 {
+		checkUserBudgetAlerts(userId)
+	}
+}
+
+// reachedBudgetThreshold returns the highest threshold in quota reached by the spending, 0 if none
+func reachedBudgetThreshold(thresholds []budgetThreshold, limit int, used int) int {
+	reached := 0
+	for _, threshold := range thresholds {
+		value := threshold.value
+		if threshold.isPercent {
+			if limit <= 0 {
+				continue
+			}
+			value = float64(limit) * threshold.value / 100
+		}
+		quota := int(math.Ceil(value))
+		if used >= quota && quota > reached {
+			reached = quota
+		}
+	}
+	return reached
+}
+
+// checkUserBudgetAlerts sends an alert if the spending reached a higher threshold than the one alerted in the period
+func checkUserBudgetAlerts(userId int) {
+	budget := &UserBudget{}
+	err := DB.First(budget, "user_id = ?", userId).Error
+	if err != nil {
+		common.SysError("failed to get user spending: " + err.Error())
+		return
+	}
+	thresholds, _ := parseBudgetThresholds(budget.AlertThresholds)
+	if len(thresholds) == 0 {
+		return
+	}
+	reached := reachedBudgetThreshold(thresholds, budget.DailyLimit, budget.DailyUsed)
+	if reached > budget.DailyAlerted && claimBudgetAlert(userId, "daily", budget.DailyStart, reached) {
+		sendBudgetAlert(budget, budgetAlertContent("今日", budget.DailyUsed, reached, budget.DailyLimit))
+	}
+	reached = reachedBudgetThreshold(thresholds, budget.MonthlyLimit, budget.MonthlyUsed)
+	if reached > budget.MonthlyAlerted && claimBudgetAlert(userId, "monthly", budget.MonthlyStart, reached) {
+		sendBudgetAlert(budget, budgetAlertContent("本月", budget.MonthlyUsed, reached, budget.MonthlyLimit))
+	}
+}
+
+// claimBudgetAlert records the threshold as alerted in the period, only one of the concurrent requests
+// crossing the same threshold succeeds and sends the alert
+func claimBudgetAlert(userId int, period string, periodStart int64, threshold int) bool {
+	result := DB.Model(&UserBudget{}).
+		Where("user_id = ? and "+period+"_start = ? and "+period+"_alerted < ?", userId, periodStart, threshold).
+		Update(period+"_alerted", threshold)
+	if result.Error != nil {
+		common.SysError("failed to claim budget alert: " + result.Error.Error())
+		return false
+	}
+	return result.RowsAffected == 1
+}
+
+func budgetAlertContent(period string, used int, threshold int, limit int) string {
+	content := fmt.Sprintf("%s已消费额度 %d，已达到您设置的提醒阈值 %d", period, used, threshold)
+	if limit > 0 {
+		content += fmt.Sprintf("，消费上限为 %d", limit)
+	}
+	return content
+}
+
+// sendBudgetAlert sends the alert to the sinks of the user, or to the email of the user if none is subscribed
+func sendBudgetAlert(budget *UserBudget, content string) {
+	email, err := GetUserEmail(budget.UserId)
+	if err != nil {
+		common.SysError("获取用户邮箱失败：" + err.Error())
+		return
+	}
+	if budget.NotificationSinks != "" {
+		sinks, err := notify.ParseUserSinks(budget.NotificationSinks)
+		if err != nil {
+			common.SysError("failed to parse the notification sinks of user " + strconv.Itoa(budget.UserId) + ": " + err.Error())
+		}
+		userSinks := make([]*notify.Sink, 0, len(sinks))
+		for _, sink := range sinks {
+			if sink.Type == notify.SinkTypeEmail {
+				// the email sinks only send to the user, the root user is the receiver if it's empty
+				if email == "" {
+					continue
+				}
+				sink.To = email
+			}
+			userSinks = append(userSinks, sink)
+		}
+		sinks = userSinks
+		if notify.SendToSinks(sinks, notify.EventBudgetAlert, "消费提醒", content) {
+			return
+		}
+	}
+	if email == "" {
+		return
+	}
+	notify.SendTo(&notify.EmailNotifier{To: email}, notify.EventBudgetAlert, "消费提醒", content)
+}
@@ -19,8 +19,8 @@ type User struct {
 	Email            string `json:"email" gorm:"index" validate:"max=50"`
 	GitHubId         string `json:"github_id" gorm:"column:github_id;index"`
 	WeChatId         string `json:"wechat_id" gorm:"column:wechat_id;index"`
-	VerificationCode string `json:"verification_code" gorm:"-:all"`                                    // this field is only for Email verification, don't save it to database!
-	AccessToken      string `json:"access_token" gorm:"type:char(32);column:access_token;uniqueIndex"` // this token is for system management
+	VerificationCode string `json:"verification_code" gorm:"-:all"`                                        // this field is only for Email verification, don't save it to database!
+	AccessToken      string `json:"access_token" gorm:"type:varchar(128);column:access_token;uniqueIndex"` // this token is for system management
 	Quota            int    `json:"quota" gorm:"type:int;default:0"`
 	Group            string `json:"group" gorm:"type:varchar(32);default:'default'"`
 }
@@ -73,7 +73,18 @@ func (user *User) Insert() error {
 	}
 	user.Quota = common.QuotaForNewUser
 	user.AccessToken = common.GetUUID()
+	accessToken := user.AccessToken
+	user.AccessToken = common.EncryptSecretDeterministic(accessToken)
 	err = DB.Create(user).Error
+	user.AccessToken = accessToken
+	if err == nil {
+		EmitWebhookEvent(WebhookEventUserCreated, map[string]any{
+			"user_id":  user.Id,
+			"username": user.Username,
+			"email":    user.Email,
+			"quota":    user.Quota,
+		})
+	}
 	return err
 }
 
@@ -85,7 +96,10 @@ func (user *User) Update(updatePassword bool) error {
 			return err
 		}
 	}
+	accessToken := user.AccessToken
+	user.AccessToken = common.EncryptSecretDeterministic(accessToken)
 	err = DB.Model(user).Updates(user).Error
+	user.AccessToken = accessToken
 	return err
 }
 
@@ -214,7 +228,7 @@ func ValidateAccessToken(token string) (user *User) {
 	}
 	token = strings.Replace(token, "Bearer ", "", 1)
 	user = &User{}
-	if DB.Where("access_token = ?", token).First(user).RowsAffected == 1 {
+	if DB.Where("access_token = ?", common.EncryptSecretDeterministic(token)).First(user).RowsAffected == 1 {
 		return user
 	}
 	return nil
@@ -0,0 +1,324 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"io"
+	"net/http"
+	"one-api/common"
+	"one-api/common/notify"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const WebhookPayloadVersion = "1"
+
+const (
+	WebhookEventUserCreated     = "user.created"
+	WebhookEventUserTopup       = "user.topup"
+	WebhookEventTokenExhausted  = "token.exhausted"
+	WebhookEventChannelDisabled = "channel.disabled"
+	WebhookEventChannelEnabled  = "channel.enabled"
+)
+
+var WebhookEvents = []string{
+	WebhookEventUserCreated,
+	WebhookEventUserTopup,
+	WebhookEventTokenExhausted,
+	WebhookEventChannelDisabled,
+	WebhookEventChannelEnabled,
+}
+
+const (
+	WebhookDeliveryStatusPending   = 1
+	WebhookDeliveryStatusSucceeded = 2
+	WebhookDeliveryStatusFailed    = 3 // gave up after WebhookMaxAttempts
+)
+
+const WebhookMaxAttempts = 8
+
+type WebhookSubscription struct {
+	Id          int    `json:"id"`
+	Name        string `json:"name" gorm:"index"`
+	URL         string `json:"url" gorm:"column:url"`
+	Secret      string `json:"secret"`
+	Events      string `json:"events"` // comma separated, "*" means all events
+	Status      int    `json:"status" gorm:"default:1"`
+	CreatedTime int64  `json:"created_time" gorm:"bigint"`
+}
+
+type WebhookDelivery struct {
+	Id              int    `json:"id"`
+	SubscriptionId  int    `json:"subscription_id" gorm:"index"`
+	EventId         string `json:"event_id" gorm:"type:varchar(64);index"`
+	Event           string `json:"event" gorm:"type:varchar(64)"`
+	Payload         string `json:"payload" gorm:"type:text"`
+	Status          int    `json:"status" gorm:"default:1;index"`
+	Attempts        int    `json:"attempts" gorm:"default:0"`
+	NextAttemptTime int64  `json:"next_attempt_time" gorm:"bigint;index"`
+	ResponseCode    int    `json:"response_code"`
+	LastError       string `json:"last_error"`
+	CreatedTime     int64  `json:"created_time" gorm:"bigint;index"`
+	UpdatedTime     int64  `json:"updated_time" gorm:"bigint"`
+}
+
+type WebhookPayload struct {
+	Id        string `json:"id"`
+	Version   string `json:"version"`
+	Event     string `json:"event"`
+	CreatedAt int64  `json:"created_at"`
+	Data      any    `json:"data"`
+}
+
+func ValidateWebhookEvents(events string) error {
+	for _, event := range strings.Split(events, ",") {
+		event = strings.TrimSpace(event)
+		if event == "*" {
+			continue
+		}
+		valid := false
+		for _, e := range WebhookEvents {
+			if e == event {
+				valid = true
+			}
+		}
+		if !valid {
+			return fmt.Errorf("未知的事件类型：%s", event)
+		}
+	}
+	return nil
+}
+
+func (subscription *WebhookSubscription) accepts(event string) bool {
+	for _, e := range strings.Split(subscription.Events, ",") {
+		e = strings.TrimSpace(e)
+		if e == "*" || e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// RedactSecret hides the secret before the subscription is returned, it's only shown in full once when created
+func (subscription *WebhookSubscription) RedactSecret() {
+	if subscription.Secret != "" {
+		subscription.Secret = redactedValue
+	}
+}
+
+// SetSecret replaces the secret, an empty or redacted secret keeps the current one
+func (subscription *WebhookSubscription) SetSecret(secret string) {
+	if secret == "" || secret == redactedValue {
+		return
+	}
+	subscription.Secret = secret
+}
+
+func GetAllWebhookSubscriptions() ([]*WebhookSubscription, error) {
+	var subscriptions []*WebhookSubscription
+	err := DB.Order("id desc").Find(&subscriptions).Error
+	return subscriptions, err
+}
+
+func GetWebhookSubscriptionById(id int) (*WebhookSubscription, error) {
+	subscription := WebhookSubscription{Id: id}
+	err := DB.First(&subscription, "id = ?", id).Error
+	return &subscription, err
+}
+
+func (subscription *WebhookSubscription) Insert() error {
+	var err error
+	secret := subscription.Secret
+	subscription.Secret, err = common.EncryptSecret(secret)
+	if err != nil {
+		return err
+	}
+	err = DB.Create(subscription).Error
+	subscription.Secret = secret
+	return err
+}
+
+func (subscription *WebhookSubscription) Update() error {
+	var err error
+	secret := subscription.Secret
+	subscription.Secret, err = common.EncryptSecret(secret)
+	if err != nil {
+		return err
+	}
+	err = DB.Model(subscription).Select("name", "url", "secret", "events", "status").Updates(subscription).Error
+	subscription.Secret = secret
+	return err
+}
+
+func (subscription *WebhookSubscription) Delete() error {
+	return DB.Delete(subscription).Error
+}
+
+// EmitWebhookEvent queues a delivery of the event for every enabled subscription, it never blocks the caller
+func EmitWebhookEvent(event string, data any) {
+	go func() {
+		var subscriptions []*WebhookSubscription
+		err := DB.Where("status = ?", common.WebhookStatusEnabled).Find(&subscriptions).Error
+		if err != nil {
+			common.SysError("failed to get webhook subscriptions: " + err.Error())
+			return
+		}
+		now := common.GetTimestamp()
+		payload := WebhookPayload{
+			Id:        common.GetUUID(),
+			Version:   WebhookPayloadVersion,
+			Event:     event,
+			CreatedAt: now,
+			Data:      data,
+		}
+		payloadBytes, err := json.Marshal(payload)
+		if err != nil {
+			common.SysError("failed to marshal webhook payload: " + err.Error())
+			return
+		}
+		for _, subscription := range subscriptions {
+			if !subscription.accepts(event) {
+				continue
+			}
+			delivery := &WebhookDelivery{
+				SubscriptionId:  subscription.Id,
+				EventId:         payload.Id,
+				Event:           event,
+				Payload:         string(payloadBytes),
+				Status:          WebhookDeliveryStatusPending,
+				NextAttemptTime: now,
+				CreatedTime:     now,
+				UpdatedTime:     now,
+			}
+			err = DB.Create(delivery).Error
+			if err != nil {
+				common.SysError("failed to queue webhook delivery: " + err.Error())
+			}
+		}
+	}()
+}
+
+func GetWebhookDeliveries(subscriptionId int, status int, startIdx int, num int) ([]*WebhookDelivery, error) {
+	var deliveries []*WebhookDelivery
+	tx := DB.Order("id desc")
+	if subscriptionId != 0 {
+		tx = tx.Where("subscription_id = ?", subscriptionId)
+	}
+	if status != 0 {
+		tx = tx.Where("status = ?", status)
+	}
+	err := tx.Limit(num).Offset(startIdx).Find(&deliveries).Error
+	return deliveries, err
+}
+
+// RedeliverWebhook queues the delivery again, e.g. after it failed and the endpoint is fixed
+func RedeliverWebhook(id int) error {
+	result := DB.Model(&WebhookDelivery{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"status":            WebhookDeliveryStatusPending,
+		"attempts":          0,
+		"next_attempt_time": common.GetTimestamp(),
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errors.New("投递记录不存在")
+	}
+	return nil
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+func webhookBackoff(attempts int) int64 {
+	backoff := int64(30) << attempts
+	if backoff > 3600 {
+		backoff = 3600
+	}
+	return backoff
+}
+
+func postWebhook(subscription *WebhookSubscription, delivery *WebhookDelivery) (int, error) {
+	req, err := http.NewRequest("POST", subscription.URL, bytes.NewBufferString(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := common.GetTimestamp()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-OneAPI-Event", delivery.Event)
+	req.Header.Set("X-OneAPI-Delivery", strconv.Itoa(delivery.Id))
+	req.Header.Set("X-OneAPI-Timestamp", strconv.FormatInt(timestamp, 10))
+	if subscription.Secret != "" {
+		req.Header.Set("X-OneAPI-Signature", notify.SignPayload(subscription.Secret, timestamp, []byte(delivery.Payload)))
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("status code %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+func processWebhookDelivery(delivery *WebhookDelivery) {
+	now := common.GetTimestamp()
+	// claim the delivery so other instances skip it while it is in flight
+	result := DB.Model(&WebhookDelivery{}).Where("id = ? and status = ? and next_attempt_time = ?", delivery.Id, WebhookDeliveryStatusPending, delivery.NextAttemptTime).
+		Update("next_attempt_time", now+60)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return
+	}
+	delivery.Attempts++
+	delivery.UpdatedTime = common.GetTimestamp()
+	// no retries for the deleted or disabled subscriptions, the delivery can be redelivered after it is enabled again
+	retry := true
+	subscription, err := GetWebhookSubscriptionById(delivery.SubscriptionId)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		err = errors.New("subscription not found")
+		retry = false
+	} else if err == nil && subscription.Status != common.WebhookStatusEnabled {
+		err = errors.New("subscription is disabled")
+		retry = false
+	}
+	if err == nil {
+		delivery.ResponseCode, err = postWebhook(subscription, delivery)
+	}
+	if err == nil {
+		delivery.Status = WebhookDeliveryStatusSucceeded
+		delivery.LastError = ""
+	} else {
+		delivery.LastError = err.Error()
+		if !retry || delivery.Attempts >= WebhookMaxAttempts {
+			delivery.Status = WebhookDeliveryStatusFailed
+		} else {
+			delivery.NextAttemptTime = now + webhookBackoff(delivery.Attempts)
+		}
+	}
+	err = DB.Model(delivery).Select("status", "attempts", "next_attempt_time", "response_code", "last_error", "updated_time").Updates(delivery).Error
+	if err != nil {
+		common.SysError("failed to update webhook delivery: " + err.Error())
+	}
+}
+
+// ProcessWebhookDeliveries sends the due deliveries every few seconds, the queue is persisted in the database
+func ProcessWebhookDeliveries(frequency int) {
+	for {
+		time.Sleep(time.Duration(frequency) * time.Second)
+		var deliveries []*WebhookDelivery
+		err := DB.Where("status = ? and next_attempt_time <= ?", WebhookDeliveryStatusPending, common.GetTimestamp()).
+			Order("id").Limit(100).Find(&deliveries).Error
+		if err != nil {
+			common.SysError("failed to get webhook deliveries: " + err.Error())
+			continue
+		}
+		for _, delivery := range deliveries {
+			processWebhookDelivery(delivery)
+		}
+	}
+}
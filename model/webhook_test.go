@@ -0,0 +1,20 @@
+package model
+
+import "testing"
+
+func TestWebhookSubscriptionSecret(t *testing.T) {
+	subscription := &WebhookSubscription{Secret: "secret"}
+	subscription.SetSecret("")
+	subscription.SetSecret(redactedValue)
+	if subscription.Secret != "secret" {
+		t.Errorf("secret = %q, want an empty or redacted secret to keep the stored one", subscription.Secret)
+	}
+	subscription.SetSecret("new-secret")
+	if subscription.Secret != "new-secret" {
+		t.Errorf("secret = %q, want %q", subscription.Secret, "new-secret")
+	}
+	subscription.RedactSecret()
+	if subscription.Secret != redactedValue {
+		t.Errorf("secret = %q, want it redacted", subscription.Secret)
+	}
+}
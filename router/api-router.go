@@ -36,6 +36,8 @@ func SetApiRouter(router *gin.Engine) {
 				selfRoute.GET("/self", controller.GetSelf)
 				selfRoute.PUT("/self", controller.UpdateSelf)
 				selfRoute.DELETE("/self", controller.DeleteSelf)
+				selfRoute.GET("/self/budget", controller.GetSelfBudget)
+				selfRoute.PUT("/self/budget", controller.UpdateSelfBudget)
 				selfRoute.GET("/token", controller.GenerateAccessToken)
 				selfRoute.POST("/topup", controller.TopUp)
 			}
@@ -58,6 +60,28 @@ func SetApiRouter(router *gin.Engine) {
 			optionRoute.GET("/", controller.GetOptions)
 			optionRoute.PUT("/", controller.UpdateOption)
 		}
+		auditRoute := apiRouter.Group("/audit")
+		auditRoute.Use(middleware.RootAuth())
+		{
+			auditRoute.GET("/", controller.GetAuditLogs)
+		}
+		contentLogRoute := apiRouter.Group("/content_log")
+		contentLogRoute.Use(middleware.RootAuth())
+		{
+			contentLogRoute.GET("/", controller.GetContentLogs)
+			contentLogRoute.PUT("/token", controller.UpdateTokenContentLogging)
+			contentLogRoute.DELETE("/", controller.PurgeContentLogs)
+		}
+		webhookRoute := apiRouter.Group("/webhook")
+		webhookRoute.Use(middleware.RootAuth())
+		{
+			webhookRoute.GET("/", controller.GetAllWebhookSubscriptions)
+			webhookRoute.POST("/", controller.AddWebhookSubscription)
+			webhookRoute.PUT("/", controller.UpdateWebhookSubscription)
+			webhookRoute.DELETE("/:id", controller.DeleteWebhookSubscription)
+			webhookRoute.GET("/delivery", controller.GetWebhookDeliveries)
+			webhookRoute.POST("/delivery/:id/redeliver", controller.RedeliverWebhook)
+		}
 		channelRoute := apiRouter.Group("/channel")
 		channelRoute.Use(middleware.AdminAuth())
 		{
@@ -66,11 +90,15 @@ func SetApiRouter(router *gin.Engine) {
 			channelRoute.GET("/models", controller.ListModels)
 			channelRoute.GET("/:id", controller.GetChannel)
 			channelRoute.GET("/test", controller.TestAllChannels)
+			channelRoute.GET("/test_results", controller.GetChannelTestResults)
+			channelRoute.GET("/latency", controller.GetChannelLatencyStats)
+			channelRoute.GET("/health/:id", controller.GetChannelHealthHistory)
 			channelRoute.GET("/test/:id", controller.TestChannel)
 			channelRoute.GET("/update_balance", controller.UpdateAllChannelsBalance)
 			channelRoute.GET("/update_balance/:id", controller.UpdateChannelBalance)
 			channelRoute.POST("/", controller.AddChannel)
 			channelRoute.PUT("/", controller.UpdateChannel)
+			channelRoute.PUT("/key", controller.UpdateChannelKeyStatus)
 			channelRoute.DELETE("/:id", controller.DeleteChannel)
 		}
 		tokenRoute := apiRouter.Group("/token")
@@ -81,6 +109,7 @@ func SetApiRouter(router *gin.Engine) {
 			tokenRoute.GET("/:id", controller.GetToken)
 			tokenRoute.POST("/", controller.AddToken)
 			tokenRoute.PUT("/", controller.UpdateToken)
+			tokenRoute.PUT("/group", middleware.AdminAuth(), controller.UpdateTokenGroup)
 			tokenRoute.DELETE("/:id", controller.DeleteToken)
 		}
 		redemptionRoute := apiRouter.Group("/redemption")
@@ -95,8 +124,19 @@ func SetApiRouter(router *gin.Engine) {
 		}
 		logRoute := apiRouter.Group("/log")
 		logRoute.GET("/", middleware.AdminAuth(), controller.GetAllLogs)
+		logRoute.DELETE("/", middleware.AdminAuth(), controller.DeleteHistoryLogs)
 		logRoute.GET("/search", middleware.AdminAuth(), controller.SearchAllLogs)
 		logRoute.GET("/self", middleware.UserAuth(), controller.GetUserLogs)
 		logRoute.GET("/self/search", middleware.UserAuth(), controller.SearchUserLogs)
+		statsRoute := apiRouter.Group("/stats")
+		statsRoute.GET("/", middleware.AdminAuth(), controller.GetUsageStats)
+		statsRoute.GET("/top", middleware.AdminAuth(), controller.GetTopUsageStats)
+		statsRoute.GET("/self", middleware.UserAuth(), controller.GetSelfUsageStats)
+		statsRoute.GET("/self/top", middleware.UserAuth(), controller.GetSelfTopUsageStats)
+		exportRoute := apiRouter.Group("/export")
+		exportRoute.GET("/logs", middleware.AdminAuth(), controller.ExportConsumeLogs)
+		exportRoute.GET("/stats", middleware.AdminAuth(), controller.ExportUsageStats)
+		exportRoute.GET("/self/logs", middleware.UserAuth(), controller.ExportSelfConsumeLogs)
+		exportRoute.GET("/self/stats", middleware.UserAuth(), controller.ExportSelfUsageStats)
 	}
 }
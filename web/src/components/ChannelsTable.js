@@ -118,6 +118,12 @@ const ChannelsTable = () => {
             已禁用
           </Label>
         );
+      case 3:
+        return (
+          <Label basic color='yellow'>
+            已自动禁用
+          </Label>
+        );
       default:
         return (
           <Label basic color='grey'>
@@ -1,7 +1,7 @@
 import React, { useEffect, useState } from 'react';
 import { Button, Form, Label, Modal, Pagination, Popup, Table } from 'semantic-ui-react';
 import { Link } from 'react-router-dom';
-import { API, copy, showError, showSuccess, showWarning, timestamp2string } from '../helpers';
+import { API, showError, showSuccess, timestamp2string } from '../helpers';
 
 import { ITEMS_PER_PAGE } from '../constants';
 
@@ -234,21 +234,7 @@ const TokensTable = () => {
                   <Table.Cell>{token.expired_time === -1 ? 'never expires' : renderTimestamp(token.expired_time)}</Table.Cell>
                   <Table.Cell>
                     <div>
-                      <Button
-                        size={'small'}
-                        positive
-                        onClick={async () => {
-                          let key = "sk-" + token.key;
-                          if (await copy(key)) {
-                            showSuccess('copied to clipboard！');
-                          } else {
-                            showWarning('Could not copy to clipboard, please copy manually, the token has been filled in the search box。');
-                            setSearchKeyword(key);
-                          }
-                        }}
-                      >
-                        copy
-                      </Button>
+                      <Label basic>{'sk-' + token.key_prefix + '...'}</Label>
                       <Popup
                         trigger={
                           <Button size='small' negative>
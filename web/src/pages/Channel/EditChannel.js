@@ -220,16 +220,12 @@ const EditChannel = () => {
               />
             </Form.Field>
           }
-          {
-            !isEdit && (
-              <Form.Checkbox
-                checked={batch}
-                label='Batch creation'
-                name='batch'
-                onChange={() => setBatch(!batch)}
-              />
-            )
-          }
+          <Form.Checkbox
+            checked={batch}
+            label='Multiple keys (one channel with a key pool)'
+            name='batch'
+            onChange={() => setBatch(!batch)}
+          />
           <Button positive onClick={submit}>submit</Button>
         </Form>
       </Segment>
@@ -1,7 +1,7 @@
 import React, { useEffect, useState } from 'react';
 import { Button, Form, Header, Message, Segment } from 'semantic-ui-react';
 import { useParams } from 'react-router-dom';
-import { API, showError, showSuccess, timestamp2string } from '../../helpers';
+import { API, copy, showError, showSuccess, showWarning, timestamp2string } from '../../helpers';
 
 const EditToken = () => {
   const params = useParams();
@@ -77,12 +77,17 @@ const EditToken = () => {
     } else {
       res = await API.post(`/api/token/`, localInputs);
     }
-    const { success, message } = res.data;
+    const { success, message, data } = res.data;
     if (success) {
       if (isEdit) {
         showSuccess('Token updated successfully！');
       } else {
-        showSuccess('Token created successfully！');
+        let key = 'sk-' + data.key;
+        if (await copy(key)) {
+          showSuccess('Token created successfully and copied to clipboard, it will not be shown again！');
+        } else {
+          showWarning(`Token created successfully, please save it now, it will not be shown again: ${key}`);
+        }
         setInputs(originInputs);
       }
     } else {